@@ -0,0 +1,147 @@
+package zoidbergtcp
+
+import (
+	"net"
+	"sort"
+	"sync"
+)
+
+// defaultBalance is the balancing algorithm used when app meta has none
+const defaultBalance = "random"
+
+// Balancer decides in which order upstreams are tried for a client,
+// implementations must be safe for concurrent use
+type Balancer interface {
+	// Order returns upstreams in the order connections should be attempted
+	Order(client net.Addr, upstreams Upstreams) Upstreams
+}
+
+// upstreamsUpdater is implemented by balancers that prepare their
+// state for all upstreams of a proxy when upstreams change, instead of
+// doing that for upstreams eligible for new connections on every call
+type upstreamsUpdater interface {
+	update(upstreams Upstreams)
+}
+
+// balancers maps balancing algorithm names to their constructors
+var balancers = map[string]func(o options) Balancer{
+	"random":              func(o options) Balancer { return randomBalancer{} },
+	"round_robin":         func(o options) Balancer { return newRoundRobinBalancer() },
+	"least_conn":          func(o options) Balancer { return leastConnBalancer{weighted: false} },
+	"weighted_least_conn": func(o options) Balancer { return leastConnBalancer{weighted: true} },
+	"p2c":                 func(o options) Balancer { return p2cBalancer{} },
+	"hash":                func(o options) Balancer { return newHashBalancer(o) },
+}
+
+// balancerNames returns names of known balancing algorithms
+func balancerNames() []string {
+	names := make([]string, 0, len(balancers))
+	for name := range balancers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// newBalancer creates a balancer for the algorithm set in options,
+// the algorithm is validated by parseOptions beforehand
+func newBalancer(o options) Balancer {
+	return balancers[o.balance](o)
+}
+
+// randomBalancer orders upstreams randomly according to their weights
+type randomBalancer struct{}
+
+// Order implements Balancer
+func (randomBalancer) Order(client net.Addr, upstreams Upstreams) Upstreams {
+	return upstreams.shuffle()
+}
+
+// roundRobinBalancer implements smooth weighted round-robin balancing,
+// it picks the first upstream in rotation and keeps the rest for retries
+type roundRobinBalancer struct {
+	mutex   sync.Mutex
+	current map[string]int
+}
+
+// newRoundRobinBalancer creates a new round-robin balancer
+func newRoundRobinBalancer() *roundRobinBalancer {
+	return &roundRobinBalancer{
+		mutex:   sync.Mutex{},
+		current: map[string]int{},
+	}
+}
+
+// Order implements Balancer
+func (b *roundRobinBalancer) Order(client net.Addr, upstreams Upstreams) Upstreams {
+	if len(upstreams) == 0 {
+		return upstreams
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	current := make(map[string]int, len(upstreams))
+	total, best := 0, 0
+
+	for i, upstream := range upstreams {
+		addr := upstream.Addr()
+		current[addr] = b.current[addr] + upstream.weight
+		total += upstream.weight
+
+		if current[addr] > current[upstreams[best].Addr()] {
+			best = i
+		}
+	}
+
+	current[upstreams[best].Addr()] -= total
+	b.current = current
+
+	ordered := make(Upstreams, 0, len(upstreams))
+	ordered = append(ordered, upstreams[best:]...)
+
+	return append(ordered, upstreams[:best]...)
+}
+
+// leastConnBalancer prefers upstreams with fewer active connections,
+// relative to their weights when weighted is set
+type leastConnBalancer struct {
+	weighted bool
+}
+
+// Order implements Balancer
+func (b leastConnBalancer) Order(client net.Addr, upstreams Upstreams) Upstreams {
+	ordered := upstreams.shuffle()
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return b.load(ordered[i]) < b.load(ordered[j])
+	})
+
+	return ordered
+}
+
+// load returns load of an upstream that is used for comparison
+func (b leastConnBalancer) load(upstream Upstream) float64 {
+	if b.weighted {
+		return float64(upstream.connections) / float64(upstream.weight)
+	}
+
+	return float64(upstream.connections)
+}
+
+// p2cBalancer implements power of two random choices: out of two upstreams
+// picked according to their weights the one with fewer connections goes first
+type p2cBalancer struct{}
+
+// Order implements Balancer
+func (p2cBalancer) Order(client net.Addr, upstreams Upstreams) Upstreams {
+	ordered := upstreams.shuffle()
+
+	if len(ordered) > 1 && ordered[1].connections < ordered[0].connections {
+		ordered[0], ordered[1] = ordered[1], ordered[0]
+	}
+
+	return ordered
+}
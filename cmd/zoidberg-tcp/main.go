@@ -1,17 +1,41 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"time"
 
 	"github.com/bobrik/zoidbergtcp"
 )
 
 func main() {
+	// state passed on upgrade is read before anything else can fail
+	inherited, state, err := zoidbergtcp.Inherited()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	listen := flag.String("listen", fmt.Sprintf("%s:%s", os.Getenv("HOST"), os.Getenv("PORT")), "listen address")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "time to wait for connections of removed proxies to finish")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "time to wait for connections to finish on shutdown")
+	upgradeTimeout := flag.Duration("upgrade-timeout", 30*time.Second, "time for a new process to start serving on upgrade")
+	connectTimeout := flag.Duration("connect-timeout", 5*time.Second, "timeout of a single connection attempt to an upstream")
+	connectAttempts := flag.Int("connect-attempts", 0, "maximum number of upstreams to try per connection, 0 means all")
+	connectDeadline := flag.Duration("connect-deadline", 0, "maximum time spent connecting to upstreams per connection, 0 means no limit")
+	connectBackoff := flag.Duration("connect-backoff", 0, "delay before retrying the next upstream, doubles with each attempt")
+	connectMaxBackoff := flag.Duration("connect-max-backoff", time.Second, "maximum delay between retries of upstreams")
+	reusePortSockets := flag.Int("reuseport-sockets", 0, "number of SO_REUSEPORT sockets per proxy address, 0 disables SO_REUSEPORT")
+	bufferSize := flag.Int("buffer-size", 32*1024, "size of buffers used to copy data")
+	tlsCertDir := flag.String("tls-cert-dir", "", "directory to resolve relative paths of TLS certificates and keys against")
+	sourceTimeout := flag.Duration("source-timeout", 0, "time to keep apps of a zoidberg source after its last push, 0 means forever")
+	sourcePriority := flag.String("source-priority", "", "comma separated names of zoidberg sources that win conflicting apps, in order")
 	flag.Parse()
 
 	if *listen == ":" {
@@ -19,10 +43,123 @@ func main() {
 		os.Exit(1)
 	}
 
-	manager := zoidbergtcp.NewManager()
-
-	err := http.ListenAndServe(*listen, manager.ServeMux())
+	management, err := managementListener(*listen, inherited)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	manager := zoidbergtcp.NewManager(zoidbergtcp.Config{
+		DrainTimeout:      *drainTimeout,
+		ConnectTimeout:    *connectTimeout,
+		ConnectAttempts:   *connectAttempts,
+		ConnectDeadline:   *connectDeadline,
+		ConnectBackoff:    *connectBackoff,
+		ConnectMaxBackoff: *connectMaxBackoff,
+		ReusePortSockets:  *reusePortSockets,
+		BufferSize:        *bufferSize,
+		TLSCertDir:        *tlsCertDir,
+		SourceTimeout:     *sourceTimeout,
+		SourcePriority:    sourcePriorityNames(*sourcePriority),
+		Listeners:         inherited,
+	})
+
+	if state != nil {
+		manager.Restore(*state)
+	}
+
+	server := &http.Server{
+		Handler: manager.ServeMux(),
+	}
+
+	go func() {
+		err := server.Serve(management)
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	if err := zoidbergtcp.Ready(); err != nil {
+		log.Printf("error reporting readiness to the parent process: %s", err)
+	}
+
+	// after upgrade management interface is served by the new process,
+	// otherwise it reports failing health until connections are drained
+	upgraded := waitForShutdown(manager, management, *upgradeTimeout)
+	if upgraded {
+		closeServer(server)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	if err := manager.Shutdown(ctx); err != nil {
+		log.Printf("error draining connections: %s", err)
+	}
+
+	if !upgraded {
+		closeServer(server)
+	}
+}
+
+// sourcePriorityNames splits comma separated source names
+func sourcePriorityNames(names string) []string {
+	priority := []string{}
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			priority = append(priority, name)
+		}
+	}
+
+	return priority
+}
+
+// closeServer closes management server
+func closeServer(server *http.Server) {
+	if err := server.Close(); err != nil {
+		log.Printf("error closing management server: %s", err)
+	}
+}
+
+// managementListener returns management listener inherited
+// from the parent process or creates a new one
+func managementListener(listen string, inherited zoidbergtcp.Listeners) (net.Listener, error) {
+	if listeners := inherited[zoidbergtcp.ManagementListener]; len(listeners) > 0 {
+		delete(inherited, zoidbergtcp.ManagementListener)
+		return listeners[0], nil
+	}
+
+	return net.Listen("tcp", listen)
+}
+
+// waitForShutdown blocks until the process should shut down, on upgrade
+// signal a new process is started that takes over listening sockets first,
+// in which case true is returned once it serves connections
+func waitForShutdown(manager *zoidbergtcp.Manager, management net.Listener, timeout time.Duration) bool {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, shutdownSignals...)
+
+	if upgradeSignal != nil {
+		signal.Notify(signals, upgradeSignal)
+	}
+
+	for sig := range signals {
+		if sig != upgradeSignal {
+			log.Printf("received %s, shutting down", sig)
+			return false
+		}
+
+		listeners := manager.Listeners()
+		listeners[zoidbergtcp.ManagementListener] = []net.Listener{management}
+
+		process, err := zoidbergtcp.Upgrade(listeners, manager.Snapshot(), timeout)
+		if err != nil {
+			log.Printf("error starting new process: %s", err)
+			continue
+		}
+
+		log.Printf("new process with pid %d is ready, shutting down", process.Pid)
+		return true
+	}
+
+	return false
 }
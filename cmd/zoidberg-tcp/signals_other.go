@@ -0,0 +1,16 @@
+//go:build !unix
+// +build !unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignal is nil since there is no signal to request
+// upgrades with on this platform
+var upgradeSignal os.Signal
+
+// shutdownSignals make the process shut down
+var shutdownSignals = []os.Signal{syscall.SIGTERM, os.Interrupt}
@@ -0,0 +1,16 @@
+//go:build unix
+// +build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignal makes the process start a new one that takes over
+// listening sockets before shutting down
+var upgradeSignal os.Signal = syscall.SIGUSR2
+
+// shutdownSignals make the process shut down
+var shutdownSignals = []os.Signal{syscall.SIGTERM, syscall.SIGINT}
@@ -0,0 +1,323 @@
+package zoidbergtcp
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// maxReusePortSockets limits the number of SO_REUSEPORT sockets per address
+const maxReusePortSockets = 64
+
+// Config holds settings shared by all proxies of a manager
+type Config struct {
+	// DrainTimeout is how long connections of a removed proxy
+	// may stay open before they are forcibly closed
+	DrainTimeout time.Duration
+
+	// ConnectTimeout is the default timeout of a single
+	// connection attempt to an upstream
+	ConnectTimeout time.Duration
+
+	// ConnectAttempts is the default maximum number of upstreams
+	// tried for a client connection, zero means all of them
+	ConnectAttempts int
+
+	// ConnectDeadline is the default limit of total time spent on
+	// connecting to upstreams for a client connection, zero means no limit
+	ConnectDeadline time.Duration
+
+	// ConnectBackoff is the default delay before the second connection
+	// attempt, it doubles with each subsequent attempt
+	ConnectBackoff time.Duration
+
+	// ConnectMaxBackoff is the default limit of the delay between
+	// connection attempts, zero means one second
+	ConnectMaxBackoff time.Duration
+
+	// ReusePortSockets is the default number of SO_REUSEPORT sockets
+	// created for each listen address, zero disables SO_REUSEPORT
+	ReusePortSockets int
+
+	// BufferSize is the default size of buffers used to copy data,
+	// zero or less means 32KiB, it is capped at 1MiB
+	BufferSize int
+
+	// TLSCertDir is the directory that relative paths of
+	// certificates and keys from app meta are resolved against
+	TLSCertDir string
+
+	// SourceTimeout is how long apps of a zoidberg source are kept after
+	// its last state push, zero means that they are kept forever
+	SourceTimeout time.Duration
+
+	// SourcePriority lists names of zoidberg sources that win conflicting
+	// apps in order of preference, other sources follow in order of names
+	SourcePriority []string
+
+	// Listeners are listening sockets inherited from the parent process,
+	// proxies use them instead of creating new ones for the same address
+	Listeners Listeners
+}
+
+// options holds settings of a single proxy that come from app meta
+type options struct {
+	balance  string
+	hashKey  string
+	health   healthOptions
+	outlier  outlierOptions
+	connect  connectOptions
+	timeouts timeoutOptions
+	tls      tlsOptions
+
+	upstreamTLS upstreamTLSOptions
+
+	sni        string
+	sniDefault bool
+
+	reusePortSockets int
+	splice           bool
+	bufferSize       int
+	proxyProtocol    string
+
+	acceptProxyProtocol  string
+	proxyProtocolTimeout time.Duration
+}
+
+// parseOptions parses proxy options from app meta
+// with defaults taken from manager config
+func parseOptions(app string, meta map[string]string, config Config) (options, error) {
+	p := &metaParser{meta: meta}
+
+	maxBackoff := config.ConnectMaxBackoff
+	if maxBackoff == 0 {
+		maxBackoff = defaultConnectMaxBackoff
+	}
+
+	bufferSize := config.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	} else if bufferSize > maxBufferSize {
+		bufferSize = maxBufferSize
+	}
+
+	o := options{
+		balance: p.choice("balance", defaultBalance, balancerNames()),
+		hashKey: p.choice("hash_key", defaultHashKey, hashKeyNames()),
+		health: healthOptions{
+			interval: p.duration("health_interval", 0),
+			timeout:  p.duration("health_timeout", defaultHealthTimeout),
+			rise:     p.integer("health_rise", defaultHealthRise, 1, math.MaxInt32),
+			fall:     p.integer("health_fall", defaultHealthFall, 1, math.MaxInt32),
+			send:     p.escaped("health_send", ""),
+			expect:   p.escaped("health_expect", ""),
+		},
+		outlier: outlierOptions{
+			failures:    p.integer("eject_failures", 0, 0, math.MaxInt32),
+			window:      p.duration("eject_window", 0),
+			duration:    p.duration("eject_duration", defaultEjectDuration),
+			maxDuration: p.duration("eject_max_duration", defaultEjectMaxDuration),
+			maxPercent:  p.integer("eject_max_percent", defaultEjectMaxPercent, 0, 100),
+		},
+		connect: connectOptions{
+			timeout:    p.duration("connect_timeout", config.ConnectTimeout),
+			attempts:   p.integer("connect_attempts", config.ConnectAttempts, 0, math.MaxInt32),
+			deadline:   p.duration("connect_deadline", config.ConnectDeadline),
+			backoff:    p.duration("connect_backoff", config.ConnectBackoff),
+			maxBackoff: p.duration("connect_max_backoff", maxBackoff),
+		},
+		timeouts: timeoutOptions{
+			idle:        p.duration("idle_timeout", 0),
+			halfClosed:  p.duration("half_closed_timeout", 0),
+			maxLifetime: p.duration("max_lifetime", 0),
+		},
+		tls: tlsOptions{
+			enabled:          p.boolean("tls", false),
+			dir:              config.TLSCertDir,
+			cert:             p.str("tls_cert", app+".crt"),
+			key:              p.str("tls_key", app+".key"),
+			minVersion:       p.choice("tls_min_version", defaultTLSMinVersion, tlsVersionNames()),
+			ciphers:          p.str("tls_ciphers", ""),
+			handshakeTimeout: p.duration("tls_handshake_timeout", defaultTLSHandshakeTimeout),
+			clientCA:         p.str("tls_client_ca", ""),
+			clientAllow:      p.str("tls_client_allow", ""),
+		},
+		upstreamTLS: upstreamTLSOptions{
+			enabled:    p.boolean("upstream_tls", false),
+			dir:        config.TLSCertDir,
+			ca:         p.str("upstream_tls_ca", ""),
+			serverName: p.str("upstream_tls_server_name", ""),
+			cert:       p.str("upstream_tls_cert", ""),
+			key:        p.str("upstream_tls_key", ""),
+		},
+		sni:              p.str("sni", ""),
+		sniDefault:       p.boolean("sni_default", false),
+		reusePortSockets: p.integer("reuseport_sockets", config.ReusePortSockets, 0, maxReusePortSockets),
+		splice:           p.boolean("splice", false),
+		bufferSize:       p.integer("buffer_size", bufferSize, 1, maxBufferSize),
+		proxyProtocol:    p.choice("proxy_protocol", "", proxyProtocolVersions()),
+
+		acceptProxyProtocol:  p.choice("accept_proxy_protocol", "", []string{acceptProxyProtocolRequired, acceptProxyProtocolOptional}),
+		proxyProtocolTimeout: p.duration("accept_proxy_protocol_timeout", defaultProxyProtocolTimeout),
+	}
+
+	checkOptions(p, o, sniRouted(meta))
+
+	return o, p.err
+}
+
+// checkOptions records errors of options that are invalid in combination
+// with each other, routed is set for apps sharing listen address
+func checkOptions(p *metaParser, o options, routed bool) {
+	if _, err := parseCipherSuites(o.tls.ciphers); err != nil {
+		p.fail("tls_ciphers", err)
+	}
+
+	if o.acceptProxyProtocol != "" && routed {
+		p.fail("accept_proxy_protocol", fmt.Errorf("it cannot be used on shared listen addresses"))
+	}
+
+	if o.tls.clientCA != "" && !o.tls.enabled {
+		p.fail("tls_client_ca", fmt.Errorf("tls must be enabled"))
+	}
+
+	if o.tls.clientAllow != "" && o.tls.clientCA == "" {
+		p.fail("tls_client_allow", fmt.Errorf("client CA must be set"))
+	}
+
+	upstreamTLS := []struct {
+		key   string
+		value string
+	}{
+		{"upstream_tls_ca", o.upstreamTLS.ca},
+		{"upstream_tls_server_name", o.upstreamTLS.serverName},
+		{"upstream_tls_cert", o.upstreamTLS.cert},
+		{"upstream_tls_key", o.upstreamTLS.key},
+	}
+
+	for _, option := range upstreamTLS {
+		if option.value != "" && !o.upstreamTLS.enabled {
+			p.fail(option.key, fmt.Errorf("upstream_tls must be enabled"))
+		}
+	}
+
+	if (o.upstreamTLS.cert == "") != (o.upstreamTLS.key == "") {
+		p.fail("upstream_tls_cert", fmt.Errorf("both certificate and key must be set"))
+	}
+}
+
+// metaParser parses typed values from app meta,
+// remembering the first error that occurred
+type metaParser struct {
+	meta map[string]string
+	err  error
+}
+
+// fail records an error for the key if there is none yet
+func (p *metaParser) fail(key string, err error) {
+	if p.err == nil {
+		p.err = fmt.Errorf("invalid %s: %s", key, err)
+	}
+}
+
+// choice returns value of the key that must be one of the allowed values
+func (p *metaParser) choice(key string, def string, allowed []string) string {
+	value, ok := p.meta[key]
+	if !ok || value == "" {
+		return def
+	}
+
+	for _, a := range allowed {
+		if value == a {
+			return value
+		}
+	}
+
+	p.fail(key, fmt.Errorf("%q is not one of %q", value, allowed))
+
+	return def
+}
+
+// str returns value of the key as is
+func (p *metaParser) str(key string, def string) string {
+	value, ok := p.meta[key]
+	if !ok || value == "" {
+		return def
+	}
+
+	return value
+}
+
+// duration returns value of the key parsed as a non-negative duration
+func (p *metaParser) duration(key string, def time.Duration) time.Duration {
+	value, ok := p.meta[key]
+	if !ok || value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("%s is negative", d)
+	}
+
+	if err != nil {
+		p.fail(key, err)
+		return def
+	}
+
+	return d
+}
+
+// integer returns value of the key parsed as an integer within bounds
+func (p *metaParser) integer(key string, def, min, max int) int {
+	value, ok := p.meta[key]
+	if !ok || value == "" {
+		return def
+	}
+
+	i, err := strconv.Atoi(value)
+	if err == nil && (i < min || i > max) {
+		err = fmt.Errorf("%d is not within [%d, %d]", i, min, max)
+	}
+
+	if err != nil {
+		p.fail(key, err)
+		return def
+	}
+
+	return i
+}
+
+// boolean returns value of the key parsed as a boolean
+func (p *metaParser) boolean(key string, def bool) bool {
+	value, ok := p.meta[key]
+	if !ok || value == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		p.fail(key, err)
+		return def
+	}
+
+	return b
+}
+
+// escaped returns value of the key with Go escape sequences
+// like \r and \n interpreted
+func (p *metaParser) escaped(key string, def string) string {
+	value, ok := p.meta[key]
+	if !ok || value == "" {
+		return def
+	}
+
+	s, err := strconv.Unquote(`"` + value + `"`)
+	if err != nil {
+		p.fail(key, err)
+		return def
+	}
+
+	return s
+}
@@ -0,0 +1,136 @@
+package zoidbergtcp
+
+import (
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+func TestParseOptionsDefaults(t *testing.T) {
+	o, err := parseOptions("app", map[string]string{"tls": "true"}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version := tlsVersions[o.tls.minVersion]; version != tls.VersionTLS12 {
+		t.Errorf("expected TLS 1.2 to be the minimum version by default, got %x", version)
+	}
+}
+
+func TestParseOptionsBufferSize(t *testing.T) {
+	cases := []struct {
+		config   int
+		meta     string
+		expected int
+	}{
+		{config: 0, expected: defaultBufferSize},
+		{config: -1, expected: defaultBufferSize},
+		{config: 4096, expected: 4096},
+		{config: maxBufferSize + 1, expected: maxBufferSize},
+		{config: -1, meta: "4096", expected: 4096},
+	}
+
+	for _, c := range cases {
+		o, err := parseOptions("app", map[string]string{"buffer_size": c.meta}, Config{BufferSize: c.config})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if o.bufferSize != c.expected {
+			t.Errorf("buffer size %d with meta %q: expected %d, got %d", c.config, c.meta, c.expected, o.bufferSize)
+		}
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	cases := []struct {
+		name string
+		meta map[string]string
+		err  string
+	}{
+		{
+			name: "defaults",
+			meta: map[string]string{},
+		},
+		{
+			name: "tls min version",
+			meta: map[string]string{"tls": "true", "tls_min_version": "1.3"},
+		},
+		{
+			name: "unknown tls min version",
+			meta: map[string]string{"tls": "true", "tls_min_version": "1.4"},
+			err:  "invalid tls_min_version",
+		},
+		{
+			name: "tls with client CA",
+			meta: map[string]string{"tls": "true", "tls_client_ca": "ca.crt", "tls_client_allow": "client"},
+		},
+		{
+			name: "client CA without tls",
+			meta: map[string]string{"tls_client_ca": "ca.crt"},
+			err:  "invalid tls_client_ca",
+		},
+		{
+			name: "client CA with tls disabled",
+			meta: map[string]string{"tls": "false", "tls_client_ca": "ca.crt"},
+			err:  "invalid tls_client_ca",
+		},
+		{
+			name: "client allow without client CA",
+			meta: map[string]string{"tls": "true", "tls_client_allow": "client"},
+			err:  "invalid tls_client_allow",
+		},
+		{
+			name: "upstream tls with all options",
+			meta: map[string]string{
+				"upstream_tls":             "true",
+				"upstream_tls_ca":          "ca.crt",
+				"upstream_tls_server_name": "upstream.example.com",
+				"upstream_tls_cert":        "client.crt",
+				"upstream_tls_key":         "client.key",
+			},
+		},
+		{
+			name: "upstream CA without upstream tls",
+			meta: map[string]string{"upstream_tls_ca": "ca.crt"},
+			err:  "invalid upstream_tls_ca",
+		},
+		{
+			name: "upstream server name without upstream tls",
+			meta: map[string]string{"upstream_tls_server_name": "upstream.example.com"},
+			err:  "invalid upstream_tls_server_name",
+		},
+		{
+			name: "upstream cert without upstream tls",
+			meta: map[string]string{"upstream_tls": "false", "upstream_tls_cert": "client.crt", "upstream_tls_key": "client.key"},
+			err:  "invalid upstream_tls_cert",
+		},
+		{
+			name: "upstream key without upstream tls",
+			meta: map[string]string{"upstream_tls_key": "client.key"},
+			err:  "invalid upstream_tls_key",
+		},
+		{
+			name: "upstream cert without key",
+			meta: map[string]string{"upstream_tls": "true", "upstream_tls_cert": "client.crt"},
+			err:  "invalid upstream_tls_cert",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := parseOptions("app", c.meta, Config{})
+			if c.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.HasPrefix(err.Error(), c.err) {
+				t.Errorf("expected error %q, got %v", c.err, err)
+			}
+		})
+	}
+}
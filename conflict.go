@@ -0,0 +1,143 @@
+package zoidbergtcp
+
+import (
+	"log"
+	"sort"
+
+	"github.com/bobrik/zoidberg/application"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var listenConflicts = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "zoidberg_proxy_listen_conflicts",
+		Help: "number of listen addresses and server names claimed by apps that lost them to other apps",
+	},
+	[]string{"app"},
+)
+
+func init() {
+	prometheus.MustRegister(listenConflicts)
+}
+
+// Conflict describes an app that claims a listen address or a server
+// name on a shared listen address that belongs to another app
+type Conflict struct {
+	Listen     string `json:"listen"`
+	ServerName string `json:"server_name,omitempty"`
+	App        string `json:"app"`
+	Owner      string `json:"owner"`
+}
+
+// claims holds resolved ownership of listen addresses, each listen address
+// either belongs to a single app or is shared by apps routed by server name
+type claims struct {
+	plain     map[string]string
+	routed    map[string]map[string]bool
+	conflicts []Conflict
+}
+
+// owns returns whether an app gets connections from its listen address
+func (c claims) owns(listen, app string) bool {
+	return c.plain[listen] == app || c.routed[listen][app]
+}
+
+// resolveClaims decides which apps get their listen addresses, an app
+// that already has a proxy keeps it, otherwise apps are considered in
+// order of their names and the first one wins, apps routed by server name
+// can only share listen address with each other
+func (m *Manager) resolveClaims(apps application.Apps) claims {
+	claimants := map[string][]application.App{}
+	for _, app := range apps {
+		if listen := app.Meta["listen"]; listen != "" {
+			claimants[listen] = append(claimants[listen], app)
+		}
+	}
+
+	c := claims{
+		plain:     map[string]string{},
+		routed:    map[string]map[string]bool{},
+		conflicts: []Conflict{},
+	}
+
+	for listen, candidates := range claimants {
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].Name < candidates[j].Name
+		})
+
+		first := m.firstClaimant(listen, candidates)
+
+		if !sniRouted(first.Meta) {
+			c.plain[listen] = first.Name
+		} else {
+			c.routed[listen] = map[string]bool{}
+		}
+
+		for _, app := range candidates {
+			if c.plain[listen] == "" && sniRouted(app.Meta) {
+				c.routed[listen][app.Name] = true
+				continue
+			}
+
+			if app.Name != first.Name {
+				c.conflicts = append(c.conflicts, Conflict{Listen: listen, App: app.Name, Owner: first.Name})
+			}
+		}
+	}
+
+	return c
+}
+
+// firstClaimant returns the app that owns listen address: the app of the
+// existing proxy or any app of the existing router if they still claim it,
+// the first app of sorted candidates otherwise
+func (m *Manager) firstClaimant(listen string, candidates []application.App) application.App {
+	for _, app := range candidates {
+		if proxy, ok := m.proxies[listen]; ok && proxy.app == app.Name && !sniRouted(app.Meta) {
+			return app
+		}
+
+		if _, ok := m.routers[listen]; ok && sniRouted(app.Meta) {
+			return app
+		}
+	}
+
+	return candidates[0]
+}
+
+// setConflicts records current conflicts and updates conflict metric
+func (m *Manager) setConflicts(conflicts []Conflict) {
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Listen != conflicts[j].Listen {
+			return conflicts[i].Listen < conflicts[j].Listen
+		}
+
+		if conflicts[i].App != conflicts[j].App {
+			return conflicts[i].App < conflicts[j].App
+		}
+
+		return conflicts[i].ServerName < conflicts[j].ServerName
+	})
+
+	listenConflicts.Reset()
+
+	for _, conflict := range conflicts {
+		if conflict.ServerName != "" {
+			log.Printf("app %s claims server name %s on %s of app %s", conflict.App, conflict.ServerName, conflict.Listen, conflict.Owner)
+		} else {
+			log.Printf("app %s claims listen %s of app %s", conflict.App, conflict.Listen, conflict.Owner)
+		}
+
+		listenConflicts.With(prometheus.Labels{"app": conflict.App}).Inc()
+	}
+
+	m.conflicts = conflicts
+}
+
+// Conflicts returns conflicts found in the last received state
+func (m *Manager) Conflicts() []Conflict {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.conflicts
+}
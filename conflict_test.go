@@ -0,0 +1,132 @@
+package zoidbergtcp
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/bobrik/zoidberg/application"
+)
+
+// claimingApp returns an app that claims listen address,
+// it is routed by server name if sni is not empty
+func claimingApp(name, listen, sni string) application.App {
+	meta := map[string]string{"listen": listen}
+	if sni != "" {
+		meta["sni"] = sni
+	}
+
+	return application.App{Name: name, Meta: meta}
+}
+
+func TestResolveClaims(t *testing.T) {
+	listen := "127.0.0.1:10001"
+	other := "127.0.0.1:10002"
+
+	cases := []struct {
+		name      string
+		apps      []application.App
+		proxy     string
+		router    bool
+		plain     map[string]string
+		routed    map[string]map[string]bool
+		conflicts []Conflict
+	}{
+		{
+			name:      "distinct listen addresses",
+			apps:      []application.App{claimingApp("a", listen, ""), claimingApp("b", other, "")},
+			plain:     map[string]string{listen: "a", other: "b"},
+			routed:    map[string]map[string]bool{},
+			conflicts: []Conflict{},
+		},
+		{
+			name:      "new claims in order of names",
+			apps:      []application.App{claimingApp("b", listen, ""), claimingApp("a", listen, "")},
+			plain:     map[string]string{listen: "a"},
+			routed:    map[string]map[string]bool{},
+			conflicts: []Conflict{{Listen: listen, App: "b", Owner: "a"}},
+		},
+		{
+			name:      "existing proxy keeps its claim",
+			apps:      []application.App{claimingApp("aaa", listen, ""), claimingApp("zzz", listen, "")},
+			proxy:     "zzz",
+			plain:     map[string]string{listen: "zzz"},
+			routed:    map[string]map[string]bool{},
+			conflicts: []Conflict{{Listen: listen, App: "aaa", Owner: "zzz"}},
+		},
+		{
+			name:      "existing proxy without claim",
+			apps:      []application.App{claimingApp("bbb", listen, ""), claimingApp("aaa", listen, "")},
+			proxy:     "zzz",
+			plain:     map[string]string{listen: "aaa"},
+			routed:    map[string]map[string]bool{},
+			conflicts: []Conflict{{Listen: listen, App: "bbb", Owner: "aaa"}},
+		},
+		{
+			name:      "routed apps share listen address",
+			apps:      []application.App{claimingApp("a", listen, "a.example.com"), claimingApp("b", listen, "b.example.com")},
+			plain:     map[string]string{},
+			routed:    map[string]map[string]bool{listen: {"a": true, "b": true}},
+			conflicts: []Conflict{},
+		},
+		{
+			name:      "plain app takes listen address from routed apps",
+			apps:      []application.App{claimingApp("a", listen, ""), claimingApp("b", listen, "b.example.com")},
+			plain:     map[string]string{listen: "a"},
+			routed:    map[string]map[string]bool{},
+			conflicts: []Conflict{{Listen: listen, App: "b", Owner: "a"}},
+		},
+		{
+			name:      "routed apps take listen address from plain app",
+			apps:      []application.App{claimingApp("a", listen, "a.example.com"), claimingApp("b", listen, "")},
+			plain:     map[string]string{},
+			routed:    map[string]map[string]bool{listen: {"a": true}},
+			conflicts: []Conflict{{Listen: listen, App: "b", Owner: "a"}},
+		},
+		{
+			name:      "existing router keeps its claim",
+			apps:      []application.App{claimingApp("a", listen, ""), claimingApp("b", listen, "b.example.com")},
+			router:    true,
+			plain:     map[string]string{},
+			routed:    map[string]map[string]bool{listen: {"b": true}},
+			conflicts: []Conflict{{Listen: listen, App: "a", Owner: "b"}},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := NewManager(Config{})
+
+			if c.proxy != "" {
+				m.proxies[listen] = newRoutedProxy(c.proxy, listen)
+			}
+
+			if c.router {
+				m.routers[listen] = &router{listen: listen, proxies: map[string]*proxy{}, names: map[string]*proxy{}}
+			}
+
+			apps := application.Apps{}
+			for _, app := range c.apps {
+				apps[app.Name] = app
+			}
+
+			claims := m.resolveClaims(apps)
+
+			sort.Slice(claims.conflicts, func(i, j int) bool {
+				return claims.conflicts[i].App < claims.conflicts[j].App
+			})
+
+			if !reflect.DeepEqual(claims.plain, c.plain) {
+				t.Errorf("expected plain claims %v, got %v", c.plain, claims.plain)
+			}
+
+			if !reflect.DeepEqual(claims.routed, c.routed) {
+				t.Errorf("expected routed claims %v, got %v", c.routed, claims.routed)
+			}
+
+			if !reflect.DeepEqual(claims.conflicts, c.conflicts) {
+				t.Errorf("expected conflicts %v, got %v", c.conflicts, claims.conflicts)
+			}
+		})
+	}
+}
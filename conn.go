@@ -0,0 +1,121 @@
+package zoidbergtcp
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// halfCloser is a connection that can be shut down in one direction
+type halfCloser interface {
+	net.Conn
+	CloseRead() error
+	CloseWrite() error
+}
+
+// clientConn is an accepted client connection, its addresses
+// can be overridden by PROXY protocol header
+type clientConn struct {
+	net.Conn
+
+	// tcp is the underlying connection, it is the same as Conn
+	// unless TLS is terminated by the proxy
+	tcp    *net.TCPConn
+	tls    *tls.Conn
+	remote net.Addr
+	local  net.Addr
+
+	// identity is the verified identity from client certificate
+	identity string
+
+	// pending is data read from the client before proxying,
+	// it must be sent to the upstream before anything else
+	pending []byte
+}
+
+// newClientConn wraps accepted connection
+func newClientConn(conn *net.TCPConn) *clientConn {
+	return &clientConn{
+		Conn:   conn,
+		tcp:    conn,
+		remote: conn.RemoteAddr(),
+		local:  conn.LocalAddr(),
+	}
+}
+
+// terminate replaces the connection with TLS connection on top of it,
+// pending data is already consumed by the handshake at this point
+func (c *clientConn) terminate(conn *tls.Conn) {
+	c.Conn = conn
+	c.tls = conn
+	c.pending = nil
+
+	if certificates := conn.ConnectionState().PeerCertificates; len(certificates) > 0 {
+		c.identity = certificateIdentity(certificates[0])
+	}
+}
+
+// stream returns connection to copy data from and to, it is the
+// underlying tcp connection when TLS is not terminated
+func (c *clientConn) stream() halfCloser {
+	if c.tls == nil {
+		return c.tcp
+	}
+
+	return &tlsConn{Conn: c.tls, tcp: c.tcp}
+}
+
+// RemoteAddr returns original address of the client
+func (c *clientConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// LocalAddr returns original address the client connected to
+func (c *clientConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// String returns client address along with its identity if there is one
+func (c *clientConn) String() string {
+	if c.identity == "" {
+		return c.remote.String()
+	}
+
+	return c.remote.String() + " (" + c.identity + ")"
+}
+
+// tlsConn is TLS connection that can be shut down in one direction
+type tlsConn struct {
+	*tls.Conn
+	tcp *net.TCPConn
+}
+
+// CloseRead shuts down reading side of the underlying connection
+func (c *tlsConn) CloseRead() error {
+	return c.tcp.CloseRead()
+}
+
+// CloseWrite sends TLS close_notify alert and shuts down
+// writing side of the underlying connection
+func (c *tlsConn) CloseWrite() error {
+	_ = c.Conn.CloseWrite()
+	return c.tcp.CloseWrite()
+}
+
+// prefixConn is a connection that returns prefix on reads
+// before reading from the connection itself
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+// Read reads remaining prefix or from the connection
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) == 0 {
+		return c.Conn.Read(b)
+	}
+
+	n := copy(b, c.prefix)
+	c.prefix = c.prefix[n:]
+
+	return n, nil
+}
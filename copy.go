@@ -0,0 +1,111 @@
+package zoidbergtcp
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// defaultBufferSize is the default size of buffers used to copy data
+	defaultBufferSize = 32 * 1024
+
+	// maxBufferSize limits the size of buffers used to copy data
+	maxBufferSize = 1024 * 1024
+
+	// accountingInterval defines how often transferred bytes
+	// of a connection are flushed to metrics
+	accountingInterval = time.Second
+)
+
+var (
+	bufferPoolsMutex sync.Mutex
+	bufferPools      = map[int]*sync.Pool{}
+)
+
+// bufferPool returns a pool of reusable buffers of the given size
+func bufferPool(size int) *sync.Pool {
+	bufferPoolsMutex.Lock()
+	defer bufferPoolsMutex.Unlock()
+
+	pool, ok := bufferPools[size]
+	if !ok {
+		pool = &sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, size)
+				return &buf
+			},
+		}
+
+		bufferPools[size] = pool
+	}
+
+	return pool
+}
+
+// bufferedCopy copies data from one connection to another through
+// a pooled buffer of the given size, calling transferred after each chunk
+func bufferedCopy(to, from net.Conn, size int, transferred func(n int64)) error {
+	pool := bufferPool(size)
+
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+
+	for {
+		n, err := from.Read(*buf)
+		if n > 0 {
+			if _, err := to.Write((*buf)[:n]); err != nil {
+				return err
+			}
+
+			transferred(int64(n))
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// byteAccount accumulates transferred bytes of one direction of a connection
+// and flushes them to a counter periodically, so the counter is not
+// updated on every chunk, bytes are recorded by the copying goroutine
+// and flushed from any goroutine
+type byteAccount struct {
+	counter  prometheus.Counter
+	activity *activity
+	total    *int64
+	pending  int64
+}
+
+// newByteAccount creates a byte account flushing to the counter,
+// total is updated immediately, so it can be read at any time
+func newByteAccount(counter prometheus.Counter, activity *activity, total *int64) *byteAccount {
+	return &byteAccount{
+		counter:  counter,
+		activity: activity,
+		total:    total,
+	}
+}
+
+// transferred records transferred bytes
+func (a *byteAccount) transferred(n int64) {
+	a.activity.touchAt(time.Now())
+	atomic.AddInt64(a.total, n)
+	atomic.AddInt64(&a.pending, n)
+}
+
+// flush adds pending bytes to the counter
+func (a *byteAccount) flush() {
+	if pending := atomic.SwapInt64(&a.pending, 0); pending > 0 {
+		a.counter.Add(float64(pending))
+	}
+}
@@ -0,0 +1,106 @@
+package zoidbergtcp
+
+import (
+	"net"
+	"syscall"
+)
+
+const (
+	// spliceSize is the maximum number of bytes moved by a single splice
+	// call, it matches the default capacity of a pipe
+	spliceSize = 1 << 16
+
+	// spliceFlags are flags for splice calls, descriptors are polled
+	// by the runtime, so splice calls must never block
+	spliceFlags = spliceMove | spliceNonblock
+
+	// spliceMove is SPLICE_F_MOVE
+	spliceMove = 0x1
+
+	// spliceNonblock is SPLICE_F_NONBLOCK
+	spliceNonblock = 0x2
+)
+
+// spliceCopy copies data from one connection to another with splice(2)
+// through a pipe, so data never leaves the kernel, transferred is called
+// after each chunk written to the destination, buffer size is only used
+// by the fallback on platforms without splice(2)
+func spliceCopy(to, from *net.TCPConn, _ int, transferred func(n int64)) error {
+	pipe := [2]int{}
+	if err := syscall.Pipe2(pipe[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		return &net.OpError{Op: "pipe", Net: "tcp", Err: err}
+	}
+
+	defer func() {
+		_ = syscall.Close(pipe[0])
+		_ = syscall.Close(pipe[1])
+	}()
+
+	src, err := from.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	dst, err := to.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	for {
+		n, err := spliceChunk(src, pipe[1], true)
+		if err != nil || n == 0 {
+			return err
+		}
+
+		for n > 0 {
+			written, err := spliceChunk(dst, pipe[0], false)
+			if err != nil {
+				return err
+			}
+
+			n -= written
+			transferred(written)
+		}
+	}
+}
+
+// spliceChunk moves data between a socket and a pipe, waiting for the
+// socket to become readable when reading or writable when writing
+func spliceChunk(socket syscall.RawConn, pipe int, read bool) (int64, error) {
+	n := int64(0)
+	serr := error(nil)
+
+	op := socket.Write
+	if read {
+		op = socket.Read
+	}
+
+	err := op(func(fd uintptr) bool {
+		var m int
+		if read {
+			m, serr = splice(int(fd), pipe)
+		} else {
+			m, serr = splice(pipe, int(fd))
+		}
+
+		n = int64(m)
+
+		return serr != syscall.EAGAIN
+	})
+
+	if err != nil {
+		return n, err
+	}
+
+	if serr != nil {
+		return n, &net.OpError{Op: "splice", Net: "tcp", Err: serr}
+	}
+
+	return n, nil
+}
+
+// splice moves up to spliceSize bytes between descriptors
+func splice(from, to int) (int, error) {
+	n, err := syscall.Splice(from, nil, to, nil, spliceSize, spliceFlags)
+	return int(n), err
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package zoidbergtcp
+
+import "net"
+
+// spliceCopy falls back to buffered copy with buffers of the given size
+// on platforms without splice(2)
+func spliceCopy(to, from *net.TCPConn, bufferSize int, transferred func(n int64)) error {
+	return bufferedCopy(to, from, bufferSize, transferred)
+}
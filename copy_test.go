@@ -0,0 +1,156 @@
+package zoidbergtcp
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// benchmarkTransfer is the amount of data copied in a single iteration
+const benchmarkTransfer = 16 * 1024 * 1024
+
+// legacyCopy is the copy loop used before buffer pooling: it copies
+// in chunks of 4KiB straight between connections, updating the counter
+// every time, io.CopyN uses ReadFrom of the connection as it did before
+func legacyCopy(to, from *net.TCPConn, c prometheus.Counter) error {
+	for {
+		n, err := io.CopyN(to, from, 4096)
+		c.Add(float64(n))
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// tcpPair returns both ends of a loopback tcp connection
+func tcpPair(b *testing.B) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	server, err := listener.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+// benchmarkCopy measures copying data from one connection to another
+func benchmarkCopy(b *testing.B, copier func(to, from *net.TCPConn) error) {
+	chunk := make([]byte, 64*1024)
+
+	b.SetBytes(benchmarkTransfer)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		source, from := tcpPair(b)
+		to, sink := tcpPair(b)
+		b.StartTimer()
+
+		go func() {
+			for sent := 0; sent < benchmarkTransfer; sent += len(chunk) {
+				if _, err := source.Write(chunk); err != nil {
+					b.Error(err)
+					break
+				}
+			}
+
+			_ = source.Close()
+		}()
+
+		done := make(chan struct{})
+		go func() {
+			_, _ = io.Copy(io.Discard, sink)
+			close(done)
+		}()
+
+		if err := copier(to, from); err != nil {
+			b.Fatal(err)
+		}
+
+		_ = to.Close()
+		<-done
+
+		_ = from.Close()
+		_ = sink.Close()
+	}
+}
+
+func BenchmarkCopyLegacy(b *testing.B) {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "legacy"})
+
+	benchmarkCopy(b, func(to, from *net.TCPConn) error {
+		return legacyCopy(to, from, counter)
+	})
+}
+
+func BenchmarkCopyPooled(b *testing.B) {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "pooled"})
+
+	benchmarkCopy(b, func(to, from *net.TCPConn) error {
+		account := newByteAccount(counter, newActivity(), new(int64))
+		return bufferedCopy(to, from, defaultBufferSize, account.transferred)
+	})
+}
+
+func BenchmarkCopySplice(b *testing.B) {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "splice"})
+
+	benchmarkCopy(b, func(to, from *net.TCPConn) error {
+		account := newByteAccount(counter, newActivity(), new(int64))
+		return spliceCopy(to, from, defaultBufferSize, account.transferred)
+	})
+}
+
+func TestByteAccountFlushedWhileIdle(t *testing.T) {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "idle"})
+	activity := newActivity()
+	account := newByteAccount(counter, activity, new(int64))
+
+	done := make(chan struct{})
+	finished := make(chan string)
+
+	go func() {
+		finished <- timeoutOptions{}.watch(done, activity, account.flush, func() {})
+	}()
+
+	account.transferred(1024)
+
+	time.Sleep(accountingInterval + accountingInterval/2)
+
+	metric := &dto.Metric{}
+	if err := counter.Write(metric); err != nil {
+		t.Fatal(err)
+	}
+
+	if value := metric.GetCounter().GetValue(); value != 1024 {
+		t.Errorf("expected 1024 bytes to be flushed while the connection is idle, got %v", value)
+	}
+
+	done <- struct{}{}
+	done <- struct{}{}
+
+	if reason := <-finished; reason != closeFinished {
+		t.Errorf("expected connection to finish, got %s", reason)
+	}
+}
@@ -0,0 +1,271 @@
+package zoidbergtcp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bobrik/zoidberg/balancer"
+)
+
+const (
+	// listenersEnv holds listen addresses and file descriptors
+	// of listening sockets passed to a child process on upgrade
+	listenersEnv = "ZOIDBERG_TCP_LISTENERS"
+
+	// stateEnv holds file descriptor of a pipe that
+	// the last known state is written to on upgrade
+	stateEnv = "ZOIDBERG_TCP_STATE_FD"
+
+	// readyEnv holds file descriptor of a pipe that a child process
+	// writes to once it serves connections after upgrade
+	readyEnv = "ZOIDBERG_TCP_READY_FD"
+
+	// ManagementListener is the key of management interface listener
+	// in listeners passed to a child process on upgrade
+	ManagementListener = "management"
+)
+
+// Listeners maps listen addresses to listening sockets
+type Listeners map[string][]net.Listener
+
+// Snapshot is the state passed to a child process on upgrade, the effective
+// state is embedded to stay compatible with versions that only know it
+type Snapshot struct {
+	balancer.State
+	Sources []Source `json:"sources,omitempty"`
+}
+
+// Inherited returns listeners and snapshot passed by the parent process
+// on upgrade, both are nil if the process was not started by Upgrade,
+// the snapshot is read first, so the parent is not left writing it
+func Inherited() (Listeners, *Snapshot, error) {
+	state, err := inheritedState(os.Getenv(stateEnv))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	listeners, err := inheritedListeners(os.Getenv(listenersEnv))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_ = os.Unsetenv(listenersEnv)
+	_ = os.Unsetenv(stateEnv)
+
+	return listeners, state, nil
+}
+
+// inheritedListeners creates listeners from the description
+// in the form of "listen=fd,listen=fd"
+func inheritedListeners(description string) (Listeners, error) {
+	if description == "" {
+		return nil, nil
+	}
+
+	listeners := Listeners{}
+
+	for _, entry := range strings.Split(description, ",") {
+		i := strings.LastIndex(entry, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid inherited listener: %q", entry)
+		}
+
+		fd, err := strconv.Atoi(entry[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid inherited listener: %q", entry)
+		}
+
+		file := os.NewFile(uintptr(fd), entry[:i])
+
+		listener, err := net.FileListener(file)
+		if err != nil {
+			return nil, fmt.Errorf("error inheriting listener %q: %s", entry, err)
+		}
+
+		_ = file.Close()
+
+		listeners[entry[:i]] = append(listeners[entry[:i]], listener)
+	}
+
+	return listeners, nil
+}
+
+// inheritedState reads snapshot from the pipe with the given descriptor
+func inheritedState(description string) (*Snapshot, error) {
+	if description == "" {
+		return nil, nil
+	}
+
+	fd, err := strconv.Atoi(description)
+	if err != nil {
+		return nil, fmt.Errorf("invalid inherited state: %q", description)
+	}
+
+	file := os.NewFile(uintptr(fd), "state")
+	defer func() {
+		_ = file.Close()
+	}()
+
+	state := &Snapshot{}
+	if err := json.NewDecoder(file).Decode(state); err != nil {
+		return nil, fmt.Errorf("error reading inherited state: %s", err)
+	}
+
+	return state, nil
+}
+
+// Ready tells the parent process that the process started by Upgrade
+// serves connections, so the parent can shut down, it does nothing
+// if the process was not started by Upgrade
+func Ready() error {
+	description := os.Getenv(readyEnv)
+	if description == "" {
+		return nil
+	}
+
+	_ = os.Unsetenv(readyEnv)
+
+	fd, err := strconv.Atoi(description)
+	if err != nil {
+		return fmt.Errorf("invalid inherited readiness pipe: %q", description)
+	}
+
+	file := os.NewFile(uintptr(fd), "ready")
+	defer func() {
+		_ = file.Close()
+	}()
+
+	_, err = file.Write([]byte{1})
+
+	return err
+}
+
+// Upgrade starts a new process of the same executable with the same
+// arguments that inherits listening sockets and the snapshot and waits
+// for it to call Ready, after that the caller is expected to shut down
+// and let the child accept connections, the child is killed if it
+// does not become ready within the timeout
+func Upgrade(listeners Listeners, state Snapshot, timeout time.Duration) (*os.Process, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	files, description, err := listenerFiles(listeners)
+	defer func() {
+		for _, file := range files {
+			_ = file.Close()
+		}
+	}()
+
+	if err != nil {
+		return nil, err
+	}
+
+	stateReader, stateWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		_ = stateReader.Close()
+		_ = stateWriter.Close()
+		return nil, err
+	}
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, stateReader, readyWriter)
+	cmd.Env = append(os.Environ(),
+		listenersEnv+"="+description,
+		stateEnv+"="+strconv.Itoa(3+len(files)),
+		readyEnv+"="+strconv.Itoa(4+len(files)),
+	)
+
+	err = cmd.Start()
+
+	// the child has its own copies of pipe ends, once ours are closed
+	// writing the snapshot fails and waiting for readiness ends
+	// as soon as the child exits
+	_ = stateReader.Close()
+	_ = readyWriter.Close()
+
+	if err != nil {
+		_ = stateWriter.Close()
+		_ = readyReader.Close()
+		return nil, err
+	}
+
+	if err := handOver(stateWriter, readyReader, state, time.Now().Add(timeout)); err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, err
+	}
+
+	return cmd.Process, nil
+}
+
+// handOver writes the snapshot to a child process and waits for it to report
+// readiness before the deadline, both pipes are closed afterwards
+func handOver(state, ready *os.File, snapshot Snapshot, deadline time.Time) error {
+	defer func() {
+		_ = ready.Close()
+	}()
+
+	err := state.SetWriteDeadline(deadline)
+	if err == nil {
+		err = json.NewEncoder(state).Encode(snapshot)
+	}
+
+	if e := state.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		return fmt.Errorf("error passing state to new process: %s", err)
+	}
+
+	if err := ready.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		return fmt.Errorf("new process did not become ready: %s", err)
+	}
+
+	return nil
+}
+
+// listenerFiles returns duplicated files of listeners along with their
+// description, descriptors start from 3 as in exec.Cmd.ExtraFiles
+func listenerFiles(listeners Listeners) ([]*os.File, string, error) {
+	files := []*os.File{}
+	entries := []string{}
+
+	for listen, ls := range listeners {
+		for _, listener := range ls {
+			tcp, ok := listener.(*net.TCPListener)
+			if !ok {
+				return files, "", fmt.Errorf("listener on %s is not a tcp listener", listener.Addr())
+			}
+
+			file, err := tcp.File()
+			if err != nil {
+				return files, "", err
+			}
+
+			entries = append(entries, fmt.Sprintf("%s=%d", listen, 3+len(files)))
+			files = append(files, file)
+		}
+	}
+
+	return files, strings.Join(entries, ","), nil
+}
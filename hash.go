@@ -0,0 +1,182 @@
+package zoidbergtcp
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// defaultHashKey is the hash key source used when app meta has none
+const defaultHashKey = "ip"
+
+// hashReplicas defines how many points on the ring an upstream
+// gets per unit of its weight
+const hashReplicas = 100
+
+// hashMaxPoints limits the number of points of the heaviest upstream,
+// points of other upstreams are scaled down proportionally
+const hashMaxPoints = 1000
+
+// hashKeys maps names of hash key sources to functions
+// that extract the key from client address
+var hashKeys = map[string]func(client net.Addr) string{
+	"ip": func(client net.Addr) string {
+		host, _, err := net.SplitHostPort(client.String())
+		if err != nil {
+			return client.String()
+		}
+
+		return host
+	},
+	"ip_port": func(client net.Addr) string {
+		return client.String()
+	},
+}
+
+// hashKeyNames returns names of known hash key sources
+func hashKeyNames() []string {
+	names := make([]string, 0, len(hashKeys))
+	for name := range hashKeys {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// hashBalancer routes clients to upstreams using consistent hashing
+// of the client address, so the same client sticks to the same upstream
+// and only a small share of clients is remapped when upstreams change
+type hashBalancer struct {
+	mutex sync.Mutex
+	key   func(client net.Addr) string
+	ring  hashRing
+}
+
+// newHashBalancer creates a new consistent hashing balancer
+func newHashBalancer(o options) *hashBalancer {
+	return &hashBalancer{
+		mutex: sync.Mutex{},
+		key:   hashKeys[o.hashKey],
+	}
+}
+
+// update implements upstreamsUpdater, the ring is built from all
+// upstreams of the proxy, so it does not change when some of them
+// become ineligible for new connections
+func (b *hashBalancer) update(upstreams Upstreams) {
+	ring := newHashRing(upstreams)
+
+	b.mutex.Lock()
+	b.ring = ring
+	b.mutex.Unlock()
+}
+
+// Order implements Balancer, upstreams are ordered as they appear
+// on the ring clockwise starting from the hash of the client,
+// upstreams missing from the ring go last
+func (b *hashBalancer) Order(client net.Addr, upstreams Upstreams) Upstreams {
+	b.mutex.Lock()
+	ring := b.ring
+	b.mutex.Unlock()
+
+	if len(ring) == 0 {
+		return upstreams
+	}
+
+	candidates := make(map[upstreamKey]Upstream, len(upstreams))
+	for _, upstream := range upstreams {
+		candidates[keyOf(upstream)] = upstream
+	}
+
+	h := hashOf(b.key(client))
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+
+	ordered := make(Upstreams, 0, len(upstreams))
+
+	for i := 0; i < len(ring) && len(candidates) > 0; i++ {
+		key := ring[(start+i)%len(ring)].key
+		if upstream, ok := candidates[key]; ok {
+			ordered = append(ordered, upstream)
+			delete(candidates, key)
+		}
+	}
+
+	for _, upstream := range upstreams {
+		if _, ok := candidates[keyOf(upstream)]; ok {
+			ordered = append(ordered, upstream)
+		}
+	}
+
+	return ordered
+}
+
+// upstreamKey identifies an upstream on the ring
+type upstreamKey struct {
+	host string
+	port int
+}
+
+// keyOf returns the key of an upstream
+func keyOf(upstream Upstream) upstreamKey {
+	return upstreamKey{host: upstream.host, port: upstream.port}
+}
+
+// hashRingPoint is a single point on the hash ring
+type hashRingPoint struct {
+	hash uint64
+	key  upstreamKey
+}
+
+// hashRing is a list of points sorted by their hashes
+type hashRing []hashRingPoint
+
+// newHashRing creates a ring where every upstream is placed at the number
+// of points proportional to its weight, the heaviest upstream gets at most
+// hashMaxPoints points, so large weights do not blow up the ring
+func newHashRing(upstreams Upstreams) hashRing {
+	maxWeight := 0
+	for _, upstream := range upstreams {
+		if upstream.weight > maxWeight {
+			maxWeight = upstream.weight
+		}
+	}
+
+	perWeight := float64(hashReplicas)
+	if maxWeight*hashReplicas > hashMaxPoints {
+		perWeight = float64(hashMaxPoints) / float64(maxWeight)
+	}
+
+	ring := hashRing{}
+
+	for _, upstream := range upstreams {
+		addr := upstream.Addr()
+
+		points := int(math.Round(float64(upstream.weight) * perWeight))
+		if points < 1 {
+			points = 1
+		}
+
+		for i := 0; i < points; i++ {
+			ring = append(ring, hashRingPoint{
+				hash: hashOf(addr + "-" + strconv.Itoa(i)),
+				key:  keyOf(upstream),
+			})
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	return ring
+}
+
+// hashOf returns a well distributed 64 bit hash of a string
+func hashOf(s string) uint64 {
+	sum := md5.Sum([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
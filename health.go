@@ -0,0 +1,240 @@
+package zoidbergtcp
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// defaultHealthTimeout is the default timeout of a single health probe
+	defaultHealthTimeout = time.Second
+
+	// defaultHealthRise is the default number of consecutive successful
+	// probes needed to consider an unhealthy upstream healthy again
+	defaultHealthRise = 2
+
+	// defaultHealthFall is the default number of consecutive failed
+	// probes needed to consider an upstream unhealthy
+	defaultHealthFall = 3
+
+	// healthReadSize limits how much data is read when
+	// looking for the expected response of a probe
+	healthReadSize = 4096
+)
+
+var upstreamHealthy = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "zoidberg_proxy_upstream_healthy",
+		Help: "whether upstream passes active health checks",
+	},
+	[]string{"app", "upstream"},
+)
+
+func init() {
+	prometheus.MustRegister(upstreamHealthy)
+}
+
+// healthOptions holds settings of active health checking,
+// checks are disabled when interval is zero
+type healthOptions struct {
+	interval time.Duration
+	timeout  time.Duration
+	rise     int
+	fall     int
+	send     string
+	expect   string
+}
+
+// healthStatus is the result of recent probes of an upstream
+type healthStatus struct {
+	healthy   bool
+	successes int
+	failures  int
+}
+
+// healthChecker periodically probes upstreams of a proxy
+type healthChecker struct {
+	mutex     sync.Mutex
+	app       string
+	options   healthOptions
+	upstreams func() Upstreams
+	statuses  map[string]*healthStatus
+	done      chan struct{}
+}
+
+// newHealthChecker creates a health checker for upstreams of an app
+func newHealthChecker(app string, o healthOptions, upstreams func() Upstreams) *healthChecker {
+	return &healthChecker{
+		mutex:     sync.Mutex{},
+		app:       app,
+		options:   o,
+		upstreams: upstreams,
+		statuses:  map[string]*healthStatus{},
+		done:      make(chan struct{}),
+	}
+}
+
+// start runs probes every interval until the checker is stopped
+func (h *healthChecker) start() {
+	ticker := time.NewTicker(h.options.interval)
+	defer ticker.Stop()
+
+	for {
+		h.check()
+
+		select {
+		case <-ticker.C:
+		case <-h.done:
+			h.forget(map[string]bool{})
+			return
+		}
+	}
+}
+
+// stop stops running probes
+func (h *healthChecker) stop() {
+	close(h.done)
+}
+
+// healthy returns whether an upstream passes health checks,
+// upstreams that were not probed yet are considered healthy
+func (h *healthChecker) healthy(upstream Upstream) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	status, ok := h.statuses[upstream.Addr()]
+
+	return !ok || status.healthy
+}
+
+// check probes all upstreams concurrently and updates their statuses
+func (h *healthChecker) check() {
+	upstreams := h.upstreams()
+	current := make(map[string]bool, len(upstreams))
+
+	wg := sync.WaitGroup{}
+
+	for _, upstream := range upstreams {
+		current[upstream.Addr()] = true
+
+		wg.Add(1)
+		go func(upstream Upstream) {
+			defer wg.Done()
+			h.record(upstream.Addr(), h.probe(upstream.Addr()))
+		}(upstream)
+	}
+
+	wg.Wait()
+
+	h.forget(current)
+}
+
+// record updates status of an upstream with the result of a probe
+func (h *healthChecker) record(addr string, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	status, ok := h.statuses[addr]
+	if !ok {
+		status = &healthStatus{healthy: true}
+		h.statuses[addr] = status
+	}
+
+	if err == nil {
+		status.successes++
+		status.failures = 0
+	} else {
+		status.failures++
+		status.successes = 0
+	}
+
+	switch {
+	case !status.healthy && status.successes >= h.options.rise:
+		status.healthy = true
+		h.log(fmt.Sprintf("upstream %s is healthy", addr))
+	case status.healthy && status.failures >= h.options.fall:
+		status.healthy = false
+		h.log(fmt.Sprintf("upstream %s is unhealthy: %s", addr, err))
+	}
+
+	value := 0.0
+	if status.healthy {
+		value = 1
+	}
+
+	upstreamHealthy.With(prometheus.Labels{"app": h.app, "upstream": addr}).Set(value)
+}
+
+// forget removes statuses of upstreams that are not current anymore
+func (h *healthChecker) forget(current map[string]bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for addr := range h.statuses {
+		if current[addr] {
+			continue
+		}
+
+		delete(h.statuses, addr)
+		upstreamHealthy.Delete(prometheus.Labels{"app": h.app, "upstream": addr})
+	}
+}
+
+// probe connects to an upstream, optionally sends a payload
+// and waits for the expected response
+func (h *healthChecker) probe(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, h.options.timeout)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if err := conn.SetDeadline(time.Now().Add(h.options.timeout)); err != nil {
+		return err
+	}
+
+	if h.options.send != "" {
+		if _, err := conn.Write([]byte(h.options.send)); err != nil {
+			return err
+		}
+	}
+
+	if h.options.expect == "" {
+		return nil
+	}
+
+	return expectResponse(conn, []byte(h.options.expect))
+}
+
+// expectResponse reads from conn until the expected bytes show up
+func expectResponse(conn net.Conn, expect []byte) error {
+	buf := make([]byte, 0, healthReadSize)
+
+	for len(buf) < cap(buf) {
+		n, err := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+
+		if bytes.Contains(buf, expect) {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("expected response not received: %s", err)
+		}
+	}
+
+	return fmt.Errorf("expected response not found in first %d bytes", len(buf))
+}
+
+func (h *healthChecker) log(msg string) {
+	log.Printf("health[app=%s]: %s", h.app, msg)
+}
@@ -1,28 +1,53 @@
 package zoidbergtcp
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/bobrik/zoidberg/application"
 	"github.com/bobrik/zoidberg/balancer"
 	"github.com/bobrik/zoidberg/state"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Manager manages proxies
 type Manager struct {
-	mutex   sync.Mutex
-	proxies map[string]*proxy
+	mutex     sync.Mutex
+	config    Config
+	state     balancer.State
+	proxies   map[string]*proxy
+	routers   map[string]*router
+	draining  map[*proxy]struct{}
+	conflicts []Conflict
+	rejected  []Rejection
+	overrides *upstreamOverrides
+	sources   map[string]Source
+	expiry    map[string]*time.Timer
+	inherited Listeners
+	shutdown  bool
 }
 
 // NewManager creates new proxy manager
-func NewManager() *Manager {
+func NewManager(config Config) *Manager {
 	return &Manager{
-		mutex:   sync.Mutex{},
-		proxies: map[string]*proxy{},
+		mutex:     sync.Mutex{},
+		config:    config,
+		proxies:   map[string]*proxy{},
+		routers:   map[string]*router{},
+		draining:  map[*proxy]struct{}{},
+		conflicts: []Conflict{},
+		rejected:  []Rejection{},
+		overrides: newUpstreamOverrides(),
+		sources:   map[string]Source{},
+		expiry:    map[string]*time.Timer{},
+		inherited: config.Listeners,
 	}
 }
 
@@ -30,63 +55,490 @@ func NewManager() *Manager {
 func (m *Manager) ServeMux() *http.ServeMux {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		state := balancer.State{}
+	mux.HandleFunc("/state/", m.serveStateUpdate)
 
-		err := json.NewDecoder(r.Body).Decode(&state)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
+	mux.HandleFunc("/conflicts", get(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.Conflicts())
+	}))
 
-		m.UpdateState(state)
-	})
+	mux.HandleFunc("/state", get(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.State())
+	}))
+
+	mux.HandleFunc("/sources", get(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.Sources())
+	}))
+
+	mux.HandleFunc("/proxies", get(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, m.Proxies())
+	}))
+
+	mux.HandleFunc("/connections", m.serveConnections)
+
+	mux.HandleFunc("/overrides", m.serveOverrides)
 
 	mux.Handle("/metrics", promhttp.Handler())
 
 	mux.HandleFunc("/_health", func(w http.ResponseWriter, r *http.Request) {
+		m.mutex.Lock()
+		shutdown := m.shutdown
+		m.mutex.Unlock()
+
+		if shutdown {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+
 		w.WriteHeader(http.StatusNoContent)
 	})
 
 	return mux
 }
 
-// UpdateState updates manager's view of the world
-func (m *Manager) UpdateState(s balancer.State) {
+// serveStateUpdate applies state pushed by zoidberg to /state/{name},
+// the response summarizes applied changes, apps that failed validation
+// are listed as rejected with 422 status code
+func (m *Manager) serveStateUpdate(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/state/")
+	if name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		writeJSONStatus(w, http.StatusMethodNotAllowed, updateError{Error: "method not allowed"})
+		return
+	}
+
+	state := balancer.State{}
+
+	if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+		writeJSONStatus(w, http.StatusBadRequest, updateError{Error: fmt.Sprintf("invalid state: %s", err)})
+		return
+	}
+
+	summary := m.UpdateSource(name, state)
+
+	if len(summary.Rejected) > 0 {
+		writeJSONStatus(w, http.StatusUnprocessableEntity, summary)
+		return
+	}
+
+	writeJSON(w, summary)
+}
+
+// updateError describes a state update that was not applied at all
+type updateError struct {
+	Error string `json:"error"`
+}
+
+// serveConnections lists active connections matching the filter from
+// query on GET and closes them on DELETE, DELETE requires a filter
+func (m *Manager) serveConnections(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseConnectionFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, m.Connections(filter))
+	case http.MethodDelete:
+		if filter.Empty() {
+			http.Error(w, "refusing to close all connections without a filter", http.StatusBadRequest)
+			return
+		}
+
+		killed := m.KillConnections(filter)
+		log.Printf("closed %d connections through management API", len(killed))
+		writeJSON(w, killed)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveOverrides lists upstream overrides on GET, sets override from
+// target, mode and optional ttl query parameters on PUT and removes
+// override of target on DELETE
+func (m *Manager) serveOverrides(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, m.Overrides())
+	case http.MethodPut:
+		ttl := time.Duration(0)
+		if value := query.Get("ttl"); value != "" {
+			var err error
+			if ttl, err = time.ParseDuration(value); err != nil {
+				http.Error(w, fmt.Sprintf("invalid ttl: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		o, err := NewOverride(query.Get("target"), query.Get("mode"), ttl)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		m.SetOverride(o)
+		writeJSON(w, o)
+	case http.MethodDelete:
+		if !m.RemoveOverride(query.Get("target")) {
+			http.Error(w, "no override for target", http.StatusNotFound)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// get wraps handler to only allow GET requests
+func get(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		handler(w, r)
+	}
+}
+
+// writeJSON writes value encoded as JSON to response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	writeJSONStatus(w, http.StatusOK, v)
+}
+
+// writeJSONStatus writes value encoded as JSON to response with status code
+func writeJSONStatus(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("error writing response: %s", err)
+	}
+}
+
+// apply updates manager's view of the world with the effective state,
+// apps that fail validation or fail to start keep their previous versions,
+// the returned summary lists changed, rejected and conflicting apps,
+// it must be called with mutex held
+func (m *Manager) apply(effective merged) UpdateSummary {
+	before := m.runningApps()
+	previous := m.state
+
+	s := effective.state
+	apps, rejected := m.acceptApps(s.Apps, effective.owners)
+
+	s.Apps = apps
+	m.state = s
+
+	c := m.resolveClaims(s.Apps)
+
+	m.removeStaleProxies(c)
+	m.removeStaleRoutes(c)
+
+	failed := []Rejection{}
+	for _, app := range s.Apps {
+		if err := m.updateAppProxies(app, s.State.Versions[app.Name], c); err != nil {
+			failed = append(failed, Rejection{App: app.Name, Source: effective.owners[app.Name], Reason: err.Error()})
+		}
+	}
+
+	for _, rejection := range failed {
+		m.revertApp(rejection.App, previous)
+		m.logRejection(rejection)
+	}
+
+	rejected = append(rejected, failed...)
+	sortRejections(rejected)
+
+	m.rejected = rejected
+
+	m.setConflicts(append(c.conflicts, m.updateRouters()...))
+	m.closeInherited()
+
+	summary := m.summarize(before, previous, rejected)
+	summary.SourceConflicts = effective.conflicts
+
+	return summary
+}
+
+// State returns the last accepted effective state
+func (m *Manager) State() balancer.State {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	for _, app := range s.Apps {
-		m.updateAppProxies(app, s.State.Versions[app.Name])
+	return m.state
+}
+
+// Listeners returns listening sockets of all active proxies
+func (m *Manager) Listeners() Listeners {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	listeners := Listeners{}
+	for listen, proxy := range m.proxies {
+		listeners[listen] = proxy.listeners
+	}
+
+	for listen, router := range m.routers {
+		listeners[listen] = router.listeners
 	}
+
+	return listeners
 }
 
-// updateAppProxies updates upstreams for running proxies
-// and starts new proxies if needed
-func (m *Manager) updateAppProxies(app application.App, versions state.Versions) {
-	listen := app.Meta["listen"]
+// closeInherited closes inherited listeners that were not claimed
+// by any app after the first state update
+func (m *Manager) closeInherited() {
+	for listen, listeners := range m.inherited {
+		log.Printf("closing unused inherited listeners for %s", listen)
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+	}
+
+	m.inherited = nil
+}
+
+// removeStaleProxies stops proxies with listen addresses that do not
+// belong to their apps anymore, their connections are drained in background
+func (m *Manager) removeStaleProxies(c claims) {
+	for listen, proxy := range m.proxies {
+		if c.plain[listen] == proxy.app {
+			continue
+		}
+
+		log.Printf("removing proxy for app %s on %s", proxy.app, listen)
+
+		delete(m.proxies, listen)
+
+		m.retire(proxy)
+	}
+}
+
+// removeStaleRoutes stops proxies of apps that do not share listen
+// addresses anymore, routers of listen addresses that are not shared
+// by any app are stopped as well
+func (m *Manager) removeStaleRoutes(c claims) {
+	for listen, router := range m.routers {
+		for _, proxy := range router.all() {
+			if c.routed[listen][proxy.app] {
+				continue
+			}
+
+			log.Printf("removing proxy for app %s on shared %s", proxy.app, listen)
+
+			router.remove(proxy.app)
+
+			m.retire(proxy)
+		}
+	}
+
+	m.removeEmptyRouters()
+}
+
+// removeEmptyRouters stops routers that have no apps left
+func (m *Manager) removeEmptyRouters() {
+	for listen, router := range m.routers {
+		if router.empty() {
+			delete(m.routers, listen)
+			router.stop()
+		}
+	}
+}
+
+// updateRouters rebuilds routes of routers after apps are updated,
+// routers are started when they get routes for the first time,
+// apps that lost server names to other apps are returned
+func (m *Manager) updateRouters() []Conflict {
+	m.removeEmptyRouters()
+
+	conflicts := []Conflict{}
+	for _, router := range m.routers {
+		conflicts = append(conflicts, router.rebuild()...)
+
+		if !router.started {
+			router.start()
+		}
+	}
+
+	return conflicts
+}
+
+// retire stops a proxy and drains its connections in background
+func (m *Manager) retire(p *proxy) {
+	p.stop()
+
+	m.draining[p] = struct{}{}
+	go m.drain(p)
+}
 
-	if listen == "" {
-		log.Printf("app %s does not have listen set in meta", app.Name)
+// drain drains connections of a stopped proxy within drain timeout
+func (m *Manager) drain(p *proxy) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.DrainTimeout)
+	defer cancel()
+
+	_ = p.drain(ctx)
+
+	m.mutex.Lock()
+	delete(m.draining, p)
+	m.mutex.Unlock()
+}
+
+// Shutdown stops accepting connections on all proxies, fails health
+// checks and waits for active connections to finish until ctx is done,
+// remaining connections are forcibly closed after that
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mutex.Lock()
+
+	m.shutdown = true
+
+	proxies := make([]*proxy, 0, len(m.proxies)+len(m.draining))
+	for listen, proxy := range m.proxies {
+		proxy.stop()
+		proxies = append(proxies, proxy)
+		delete(m.proxies, listen)
+	}
+
+	for listen, router := range m.routers {
+		router.stop()
+		for _, proxy := range router.all() {
+			proxy.stop()
+			proxies = append(proxies, proxy)
+		}
+		delete(m.routers, listen)
+	}
+
+	for proxy := range m.draining {
+		proxies = append(proxies, proxy)
+	}
+
+	m.mutex.Unlock()
+
+	errs := make(chan error, len(proxies))
+	for _, p := range proxies {
+		go func(p *proxy) {
+			errs <- p.drain(ctx)
+		}(p)
+	}
+
+	var err error
+	for range proxies {
+		if e := <-errs; e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// revertApp restores definition and versions of an app from the previous
+// state, apps that were not there before are removed from the state
+func (m *Manager) revertApp(name string, previous balancer.State) {
+	if app, ok := previous.Apps[name]; ok {
+		m.state.Apps[name] = app
+	} else {
+		delete(m.state.Apps, name)
+	}
+
+	versions, ok := previous.State.Versions[name]
+	if !ok {
+		delete(m.state.State.Versions, name)
 		return
 	}
 
+	if m.state.State.Versions == nil {
+		m.state.State.Versions = map[string]state.Versions{}
+	}
+
+	m.state.State.Versions[name] = versions
+}
+
+// updateAppProxies updates upstreams for running proxies and starts
+// new proxies if needed, running proxies are left intact on error
+func (m *Manager) updateAppProxies(app application.App, versions state.Versions, c claims) error {
+	listen := app.Meta["listen"]
+
+	if !c.owns(listen, app.Name) {
+		return nil
+	}
+
+	o, err := parseOptions(app.Name, app.Meta, m.config)
+	if err != nil {
+		return fmt.Errorf("invalid meta: %s", err)
+	}
+
+	if c.routed[listen][app.Name] {
+		return m.updateRoutedProxy(app, listen, o, versions)
+	}
+
 	if proxy, ok := m.proxies[listen]; ok {
-		if proxy.app != app.Name {
-			log.Printf("app %s to overwrites listen of app %s: %s", app.Name, proxy.app, listen)
+		if err := proxy.setState(o, app.Servers, versions); err != nil {
+			return fmt.Errorf("error updating proxy: %s", err)
 		}
-		proxy.setState(app.Servers, versions)
-		return
+
+		return nil
 	}
 
-	proxy, err := newProxy(app.Name, listen)
+	proxy, err := newProxy(app.Name, listen, o, m.inherited[listen])
+	delete(m.inherited, listen)
 	if err != nil {
-		log.Printf("error creating proxy for app %s: %s", listen, err)
-		return
+		return fmt.Errorf("error creating proxy: %s", err)
+	}
+
+	proxy.overrides = m.overrides
+
+	if err := proxy.setState(o, app.Servers, versions); err != nil {
+		proxyCreationErrors.With(proxy.labels).Inc()
+		proxy.stop()
+		return fmt.Errorf("error creating proxy: %s", err)
 	}
 
-	proxy.setState(app.Servers, versions)
 	go proxy.start()
 
 	m.proxies[listen] = proxy
+
+	return nil
+}
+
+// updateRoutedProxy updates proxy of an app on a shared listen address,
+// starting the router of the listen address if needed
+func (m *Manager) updateRoutedProxy(app application.App, listen string, o options, versions state.Versions) error {
+	router, ok := m.routers[listen]
+	if !ok {
+		var err error
+		router, err = newRouter(listen, o.reusePortSockets, m.inherited[listen])
+		delete(m.inherited, listen)
+		if err != nil {
+			proxyCreationErrors.With(prometheus.Labels{"app": app.Name}).Inc()
+			return fmt.Errorf("error creating router for shared %s: %s", listen, err)
+		}
+
+		m.routers[listen] = router
+	}
+
+	proxy := router.get(app.Name)
+	if proxy == nil {
+		proxy = newRoutedProxy(app.Name, listen)
+		proxy.overrides = m.overrides
+		if err := proxy.setState(o, app.Servers, versions); err != nil {
+			proxyCreationErrors.With(proxy.labels).Inc()
+			proxy.stop()
+			return fmt.Errorf("error creating proxy: %s", err)
+		}
+	} else if err := proxy.setState(o, app.Servers, versions); err != nil {
+		return fmt.Errorf("error updating proxy: %s", err)
+	}
+
+	router.set(proxy)
+
+	return nil
 }
@@ -0,0 +1,231 @@
+package zoidbergtcp
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// defaultEjectDuration is the default time an upstream
+	// is ejected for the first time
+	defaultEjectDuration = 30 * time.Second
+
+	// defaultEjectMaxDuration is the default cap of ejection time
+	defaultEjectMaxDuration = 5 * time.Minute
+
+	// defaultEjectMaxPercent is the default share of upstreams
+	// that can be ejected at the same time
+	defaultEjectMaxPercent = 50
+)
+
+var (
+	upstreamEjections = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "zoidberg_proxy_upstream_ejections",
+			Help: "number of times upstream was ejected after connection errors",
+		},
+		[]string{"app", "upstream"},
+	)
+
+	upstreamsEjected = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "zoidberg_proxy_upstreams_ejected",
+			Help: "number of currently ejected upstreams per proxy",
+		},
+		[]string{"app"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(upstreamEjections)
+	prometheus.MustRegister(upstreamsEjected)
+}
+
+// outlierOptions holds settings of passive outlier detection,
+// detection is disabled when failures is zero
+type outlierOptions struct {
+	failures    int
+	window      time.Duration
+	duration    time.Duration
+	maxDuration time.Duration
+	maxPercent  int
+}
+
+// outlierStatus tracks connection errors and ejections of an upstream
+type outlierStatus struct {
+	failures     int
+	since        time.Time
+	ejections    int
+	ejectedUntil time.Time
+}
+
+// outlierDetector ejects upstreams that fail to accept connections
+type outlierDetector struct {
+	mutex    sync.Mutex
+	app      string
+	options  outlierOptions
+	statuses map[string]*outlierStatus
+	stopped  bool
+}
+
+// newOutlierDetector creates an outlier detector for upstreams of an app
+func newOutlierDetector(app string, o outlierOptions) *outlierDetector {
+	return &outlierDetector{
+		mutex:    sync.Mutex{},
+		app:      app,
+		options:  o,
+		statuses: map[string]*outlierStatus{},
+		stopped:  false,
+	}
+}
+
+// ejected returns whether an upstream is currently ejected
+func (d *outlierDetector) ejected(upstream Upstream) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	status, ok := d.statuses[upstream.Addr()]
+
+	return ok && time.Now().Before(status.ejectedUntil)
+}
+
+// success records a successful connection to an upstream
+func (d *outlierDetector) success(upstream Upstream) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if status, ok := d.statuses[upstream.Addr()]; ok && d.options.window == 0 {
+		status.failures = 0
+	}
+}
+
+// failure records a connection error for an upstream and ejects it when
+// there are too many errors, total is the number of upstreams of the app
+func (d *outlierDetector) failure(upstream Upstream, total int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	addr := upstream.Addr()
+	now := time.Now()
+
+	status, ok := d.statuses[addr]
+	if !ok {
+		status = &outlierStatus{}
+		d.statuses[addr] = status
+	}
+
+	if d.options.window > 0 && now.Sub(status.since) > d.options.window {
+		status.failures = 0
+	}
+
+	if status.failures == 0 {
+		status.since = now
+	}
+
+	status.failures++
+
+	if status.failures < d.options.failures || now.Before(status.ejectedUntil) {
+		return
+	}
+
+	if (d.count(now)+1)*100 > total*d.options.maxPercent {
+		d.log(fmt.Sprintf("not ejecting %s: %d%% of upstreams are allowed to be ejected", addr, d.options.maxPercent))
+		return
+	}
+
+	d.eject(addr, status, now)
+}
+
+// eject ejects an upstream for exponentially growing period of time,
+// it must be called with mutex held
+func (d *outlierDetector) eject(addr string, status *outlierStatus, now time.Time) {
+	if now.Sub(status.ejectedUntil) > d.options.maxDuration {
+		status.ejections = 0
+	}
+
+	duration := d.options.duration
+	for i := 0; i < status.ejections && duration < d.options.maxDuration; i++ {
+		duration *= 2
+	}
+
+	if duration > d.options.maxDuration {
+		duration = d.options.maxDuration
+	}
+
+	status.ejections++
+	status.failures = 0
+	status.ejectedUntil = now.Add(duration)
+
+	d.log(fmt.Sprintf("ejected %s for %s after connection errors", addr, duration))
+
+	upstreamEjections.With(prometheus.Labels{"app": d.app, "upstream": addr}).Inc()
+	upstreamsEjected.With(prometheus.Labels{"app": d.app}).Set(float64(d.count(now)))
+
+	time.AfterFunc(duration, d.refresh)
+}
+
+// refresh recalculates the number of ejected upstreams
+// after an ejection expires
+func (d *outlierDetector) refresh() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.stopped {
+		return
+	}
+
+	upstreamsEjected.With(prometheus.Labels{"app": d.app}).Set(float64(d.count(time.Now())))
+}
+
+// count returns the number of currently ejected upstreams,
+// it must be called with mutex held
+func (d *outlierDetector) count(now time.Time) int {
+	ejected := 0
+	for _, status := range d.statuses {
+		if now.Before(status.ejectedUntil) {
+			ejected++
+		}
+	}
+
+	return ejected
+}
+
+// update refreshes the number of ejected upstreams and forgets
+// upstreams that are not current anymore
+func (d *outlierDetector) update(upstreams Upstreams) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	current := make(map[string]bool, len(upstreams))
+	for _, upstream := range upstreams {
+		current[upstream.Addr()] = true
+	}
+
+	for addr := range d.statuses {
+		if !current[addr] {
+			delete(d.statuses, addr)
+			upstreamEjections.Delete(prometheus.Labels{"app": d.app, "upstream": addr})
+		}
+	}
+
+	upstreamsEjected.With(prometheus.Labels{"app": d.app}).Set(float64(d.count(time.Now())))
+}
+
+// stop removes metrics of the detector
+func (d *outlierDetector) stop() {
+	d.update(Upstreams{})
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.stopped = true
+	upstreamsEjected.Delete(prometheus.Labels{"app": d.app})
+}
+
+func (d *outlierDetector) log(msg string) {
+	log.Printf("outliers[app=%s]: %s", d.app, msg)
+}
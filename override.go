@@ -0,0 +1,178 @@
+package zoidbergtcp
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// OverrideDrain stops new connections to an upstream,
+	// existing connections are left intact
+	OverrideDrain = "drain"
+
+	// OverrideDisable stops new connections to an upstream
+	// and closes existing ones
+	OverrideDisable = "disable"
+)
+
+// Override takes upstreams out of rotation regardless of the state,
+// target is either host:port of a single upstream or host to match
+// upstreams on all ports, overrides without expiration never expire
+type Override struct {
+	Target  string     `json:"target"`
+	Mode    string     `json:"mode"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// matches returns whether the override applies to an upstream
+func (o Override) matches(upstream Upstream) bool {
+	return o.Target == upstream.Addr() || o.Target == upstream.Host()
+}
+
+// expired returns whether the override is expired at the given time
+func (o Override) expired(now time.Time) bool {
+	return o.Expires != nil && !now.Before(*o.Expires)
+}
+
+// NewOverride creates an override with ttl, zero ttl means no expiration
+func NewOverride(target, mode string, ttl time.Duration) (Override, error) {
+	if mode != OverrideDrain && mode != OverrideDisable {
+		return Override{}, fmt.Errorf("mode %q is not one of %q", mode, []string{OverrideDrain, OverrideDisable})
+	}
+
+	if host, port, err := net.SplitHostPort(target); err == nil {
+		if p, err := strconv.Atoi(port); host == "" || err != nil || p < 1 || p > 65535 {
+			return Override{}, fmt.Errorf("invalid target: %q", target)
+		}
+	} else if target == "" {
+		return Override{}, fmt.Errorf("target is not set")
+	}
+
+	if ttl < 0 {
+		return Override{}, fmt.Errorf("ttl %s is negative", ttl)
+	}
+
+	o := Override{Target: target, Mode: mode}
+	if ttl > 0 {
+		expires := time.Now().Add(ttl)
+		o.Expires = &expires
+	}
+
+	return o, nil
+}
+
+// upstreamOverrides holds overrides shared by all proxies of a manager
+type upstreamOverrides struct {
+	mutex     sync.Mutex
+	overrides map[string]Override
+}
+
+// newUpstreamOverrides creates an empty set of overrides
+func newUpstreamOverrides() *upstreamOverrides {
+	return &upstreamOverrides{
+		mutex:     sync.Mutex{},
+		overrides: map[string]Override{},
+	}
+}
+
+// set adds or replaces override for its target
+func (u *upstreamOverrides) set(o Override) {
+	u.mutex.Lock()
+	u.overrides[o.Target] = o
+	u.mutex.Unlock()
+
+	if o.Expires == nil {
+		log.Printf("overrides: set %s for %s", o.Mode, o.Target)
+	} else {
+		log.Printf("overrides: set %s for %s until %s", o.Mode, o.Target, o.Expires.Format(time.RFC3339))
+	}
+}
+
+// remove removes override of a target, it returns false if there was none
+func (u *upstreamOverrides) remove(target string) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if _, ok := u.overrides[target]; !ok {
+		return false
+	}
+
+	delete(u.overrides, target)
+
+	log.Printf("overrides: removed override for %s", target)
+
+	return true
+}
+
+// mode returns mode of the override applied to an upstream, overrides of
+// a single upstream take precedence over overrides of the whole host
+func (u *upstreamOverrides) mode(upstream Upstream) string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	now := time.Now()
+
+	for _, target := range []string{upstream.Addr(), upstream.Host()} {
+		if o, ok := u.overrides[target]; ok && !o.expired(now) {
+			return o.Mode
+		}
+	}
+
+	return ""
+}
+
+// list returns active overrides, expired overrides are forgotten
+func (u *upstreamOverrides) list() []Override {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	now := time.Now()
+
+	overrides := []Override{}
+	for target, o := range u.overrides {
+		if o.expired(now) {
+			delete(u.overrides, target)
+			log.Printf("overrides: %s for %s expired", o.Mode, target)
+			continue
+		}
+
+		overrides = append(overrides, o)
+	}
+
+	sort.Slice(overrides, func(i, j int) bool {
+		return overrides[i].Target < overrides[j].Target
+	})
+
+	return overrides
+}
+
+// Overrides returns active upstream overrides
+func (m *Manager) Overrides() []Override {
+	return m.overrides.list()
+}
+
+// SetOverride takes upstreams out of rotation, connections
+// to disabled upstreams are closed
+func (m *Manager) SetOverride(o Override) {
+	m.overrides.set(o)
+
+	if o.Mode != OverrideDisable {
+		return
+	}
+
+	killed := m.KillConnections(ConnectionFilter{Upstream: o.Target})
+	if len(killed) > 0 {
+		log.Printf("overrides: closed %d connections to %s", len(killed), o.Target)
+	}
+}
+
+// RemoveOverride brings upstreams back into rotation,
+// it returns false if there was no override for the target
+func (m *Manager) RemoveOverride(target string) bool {
+	return m.overrides.remove(target)
+}
@@ -1,24 +1,26 @@
 package zoidbergtcp
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
-	"io"
 	"log"
-	"math/rand"
 	"net"
 	"reflect"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/bobrik/zoidberg/application"
 	"github.com/bobrik/zoidberg/state"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-// copySize defines the size of a chunk that is used when copying data,
-// it also defines minimum granularity for stats
-const copySize = 4096
+// drainCheckInterval defines how often a draining proxy checks
+// whether all of its connections are closed
+const drainCheckInterval = 100 * time.Millisecond
 
 var (
 	bytesSent = prometheus.NewCounterVec(
@@ -92,6 +94,23 @@ var (
 		},
 		[]string{"app"},
 	)
+
+	proxyProtocolErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "zoidberg_proxy_protocol_errors",
+			Help: "number of client connections with malformed PROXY protocol header",
+		},
+		[]string{"app"},
+	)
+
+	connectAttempts = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "zoidberg_proxy_connect_attempts",
+			Help:    "number of upstream connection attempts per client connection",
+			Buckets: prometheus.LinearBuckets(1, 1, 10),
+		},
+		[]string{"app"},
+	)
 )
 
 func init() {
@@ -104,6 +123,58 @@ func init() {
 	prometheus.MustRegister(proxyUpstreamUpdates)
 	prometheus.MustRegister(proxiesCreated)
 	prometheus.MustRegister(proxyCreationErrors)
+	prometheus.MustRegister(proxyProtocolErrors)
+	prometheus.MustRegister(connectAttempts)
+}
+
+// defaultConnectMaxBackoff limits delay between connection attempts
+// when it is not set in manager config
+const defaultConnectMaxBackoff = time.Second
+
+// connectOptions holds settings of connecting to upstreams
+type connectOptions struct {
+	timeout    time.Duration
+	attempts   int
+	deadline   time.Duration
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// delay returns the delay before the next connection attempt after the
+// given number of attempts, it doubles with each attempt up to max backoff
+func (o connectOptions) delay(attempts int) time.Duration {
+	if o.backoff <= 0 {
+		return 0
+	}
+
+	delay := o.backoff
+	for i := 1; i < attempts; i++ {
+		if delay > o.maxBackoff/2 {
+			return o.maxBackoff
+		}
+
+		delay *= 2
+	}
+
+	if delay > o.maxBackoff {
+		return o.maxBackoff
+	}
+
+	return delay
+}
+
+// wait sleeps before the next connection attempt after the given number of
+// attempts, it returns false if the next attempt would happen past deadline
+func (o connectOptions) wait(attempts int, deadline time.Time) bool {
+	delay := o.delay(attempts)
+
+	if !deadline.IsZero() && !time.Now().Add(delay).Before(deadline) {
+		return false
+	}
+
+	time.Sleep(delay)
+
+	return true
 }
 
 // proxy represents a tcp proxy with upstreams
@@ -113,13 +184,65 @@ type proxy struct {
 	listen    string
 	listeners []net.Listener
 	upstreams Upstreams
+	options   options
+	balancer  Balancer
+	health    *healthChecker
+	outliers  *outlierDetector
+	serverTLS *tls.Config
+	clientTLS *tls.Config
+	overrides *upstreamOverrides
+	active    map[string]int
 	labels    prometheus.Labels
+	conns     map[net.Conn]*connection
+	done      chan struct{}
+}
+
+// newProxy creates a new tcp proxy, inherited listeners
+// are used instead of creating new ones if there are any
+func newProxy(app string, listen string, o options, inherited []net.Listener) (*proxy, error) {
+	labels := prometheus.Labels{"app": app}
+
+	listeners := inherited
+	if len(listeners) == 0 {
+		var err error
+		if listeners, err = listenAll(listen, o.reusePortSockets); err != nil {
+			proxyCreationErrors.With(labels).Inc()
+			return nil, err
+		}
+	}
+
+	return makeProxy(app, listen, listeners), nil
+}
+
+// newRoutedProxy creates a new tcp proxy without listeners,
+// connections are handed over to it by the router of listen
+func newRoutedProxy(app string, listen string) *proxy {
+	return makeProxy(app, listen, nil)
 }
 
-// newProxy creates a new tcp proxy
-func newProxy(app string, listen string) (*proxy, error) {
+// makeProxy creates a new tcp proxy with the given listeners
+func makeProxy(app string, listen string, listeners []net.Listener) *proxy {
 	labels := prometheus.Labels{"app": app}
 
+	proxiesCreated.With(labels).Inc()
+
+	return &proxy{
+		mutex:     sync.Mutex{},
+		app:       app,
+		listen:    listen,
+		listeners: listeners,
+		upstreams: []Upstream{},
+		active:    map[string]int{},
+		labels:    labels,
+		conns:     map[net.Conn]*connection{},
+		done:      make(chan struct{}),
+	}
+}
+
+// listenAll creates listeners for all addresses the host of listen
+// resolves to, if sockets is not zero, then this number of SO_REUSEPORT
+// sockets is created for each address to spread accepts between them
+func listenAll(listen string, sockets int) ([]net.Listener, error) {
 	hostname, port, err := net.SplitHostPort(listen)
 	if err != nil {
 		return nil, err
@@ -130,34 +253,92 @@ func newProxy(app string, listen string) (*proxy, error) {
 		return nil, err
 	}
 
-	listeners := make([]net.Listener, len(addrs))
+	lc := net.ListenConfig{}
+	if sockets > 0 {
+		lc.Control = reusePortControl
+	} else {
+		sockets = 1
+	}
 
-	for i, addr := range addrs {
-		listener, err := net.Listen("tcp", net.JoinHostPort(addr, port))
-		if err != nil {
-			proxyCreationErrors.With(labels).Inc()
-			return nil, err
+	listeners := make([]net.Listener, 0, len(addrs)*sockets)
+
+	for _, addr := range addrs {
+		for i := 0; i < sockets; i++ {
+			listener, err := lc.Listen(context.Background(), "tcp", net.JoinHostPort(addr, port))
+			if err != nil {
+				for _, l := range listeners {
+					_ = l.Close()
+				}
+
+				return nil, err
+			}
+
+			listeners = append(listeners, listener)
 		}
+	}
+
+	return listeners, nil
+}
+
+// setState sets state for the proxy based on options from app meta,
+// servers and their versions, nothing is changed on error
+func (p *proxy) setState(o options, servers []application.Server, versions state.Versions) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
-		listeners[i] = listener
+	if err := p.setTLS(o); err != nil {
+		return err
 	}
 
-	proxiesCreated.With(labels).Inc()
+	balancerChanged := p.setBalancer(o)
 
-	return &proxy{
-		mutex:     sync.Mutex{},
-		app:       app,
-		listen:    listen,
-		listeners: listeners,
-		upstreams: []Upstream{},
-		labels:    labels,
-	}, nil
+	if o.health != p.options.health {
+		p.setHealthChecker(o.health)
+	}
+
+	if o.outlier != p.options.outlier {
+		p.setOutlierDetector(o.outlier)
+	}
+
+	p.options = o
+
+	upstreams := upstreamsOf(servers, versions)
+
+	if p.outliers != nil {
+		p.outliers.update(upstreams)
+	}
+
+	upstreamsChanged := !reflect.DeepEqual(upstreams, p.upstreams)
+	if upstreamsChanged {
+		p.upstreams = upstreams
+		p.log(fmt.Sprintf("updated upstreams: %s", upstreams))
+		proxyUpstreamUpdates.With(p.labels).Inc()
+		proxyUpstreams.With(p.labels).Set(float64(len(p.upstreams)))
+	}
+
+	if updater, ok := p.balancer.(upstreamsUpdater); ok && (balancerChanged || upstreamsChanged) {
+		updater.update(p.upstreams)
+	}
+
+	return nil
 }
 
-// setState sets state for the proxy based on servers and their versions
-func (p *proxy) setState(servers []application.Server, versions state.Versions) {
-	p.mutex.Lock()
+// setBalancer creates a new balancer if balancing options changed,
+// it returns whether the balancer was replaced
+func (p *proxy) setBalancer(o options) bool {
+	if p.balancer != nil && o.balance == p.options.balance && o.hashKey == p.options.hashKey {
+		return false
+	}
 
+	p.balancer = newBalancer(o)
+	p.log(fmt.Sprintf("using %s balancing", o.balance))
+
+	return true
+}
+
+// upstreamsOf returns sorted upstreams of servers with weights
+// from their versions, servers with zero weight are skipped
+func upstreamsOf(servers []application.Server, versions state.Versions) Upstreams {
 	upstreams := Upstreams{}
 
 	for _, server := range servers {
@@ -166,7 +347,7 @@ func (p *proxy) setState(servers []application.Server, versions state.Versions)
 			weight = versions[server.Version].Weight
 		}
 
-		if weight == 0 {
+		if weight <= 0 {
 			continue
 		}
 
@@ -179,14 +360,15 @@ func (p *proxy) setState(servers []application.Server, versions state.Versions)
 
 	sort.Sort(upstreams)
 
-	if !reflect.DeepEqual(upstreams, p.upstreams) {
-		p.upstreams = upstreams
-		p.log(fmt.Sprintf("updated upstreams: %s", upstreams))
-		proxyUpstreamUpdates.With(p.labels).Inc()
-		proxyUpstreams.With(p.labels).Set(float64(len(p.upstreams)))
-	}
+	return upstreams
+}
 
-	p.mutex.Unlock()
+// currentOptions returns current options of the proxy
+func (p *proxy) currentOptions() options {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.options
 }
 
 // start starts main proxy loop
@@ -197,98 +379,534 @@ func (p *proxy) start() {
 			for {
 				client, err := listener.Accept()
 				if err != nil {
+					select {
+					case <-p.done:
+						return
+					default:
+					}
+
 					p.log(fmt.Sprintf("error on accepting: %s", err))
 					continue
 				}
 
 				connectionsAccepted.With(p.labels).Inc()
 
-				go p.serve(client.(*net.TCPConn))
+				go p.serve(client.(*net.TCPConn), nil)
 			}
 		}(listener)
 	}
 }
 
-// serve serves a single accepted connection
-func (p *proxy) serve(client *net.TCPConn) {
+// serve serves a single accepted connection, data that was already
+// read from the connection is passed in pending
+func (p *proxy) serve(conn *net.TCPConn, pending []byte) {
 	connected := connectedClients.With(p.labels)
 	connected.Inc()
 
+	record := p.track(conn)
+
 	defer func() {
+		p.untrack(conn)
 		connected.Dec()
-		_ = client.Close()
+		_ = conn.Close()
 	}()
 
 	p.mutex.Lock()
-	upstreams := make([]Upstream, len(p.upstreams))
-	copy(upstreams, p.upstreams)
+	balancer := p.balancer
+	o := p.options
+	serverTLS := p.serverTLS
+	upstreams := p.candidates()
+	p.mutex.Unlock()
+
+	client, err := p.accept(conn, pending, o, serverTLS)
+	if err != nil {
+		p.log(fmt.Sprintf("error accepting connection from %s: %s", conn.RemoteAddr(), err))
+		return
+	}
+
+	record.accepted(client)
+
+	backend, upstream, err := p.connect(client, balancer.Order(client.RemoteAddr(), upstreams), o)
+	if err != nil {
+		p.log(fmt.Sprintf("error connecting from %s: %s", client, err))
+		return
+	}
+
+	record.connected(upstream)
+
+	p.acquire(upstream)
+	p.proxyLoop(client, backend, o, record)
+	p.release(upstream)
+}
+
+// accept prepares accepted connection for proxying, reading PROXY
+// protocol header from it and terminating TLS if needed
+func (p *proxy) accept(conn *net.TCPConn, pending []byte, o options, serverTLS *tls.Config) (*clientConn, error) {
+	client := newClientConn(conn)
+	client.pending = pending
+
+	if o.acceptProxyProtocol != "" {
+		if err := p.acceptProxyProtocol(client, o); err != nil {
+			return nil, err
+		}
+	}
+
+	if serverTLS != nil {
+		server, err := p.handshake(&prefixConn{Conn: conn, prefix: client.pending}, serverTLS, o.tls.handshakeTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("error in TLS handshake: %s", err)
+		}
+
+		client.terminate(server)
+	}
+
+	return client, nil
+}
+
+// acceptProxyProtocol reads PROXY protocol header from a client connection
+func (p *proxy) acceptProxyProtocol(client *clientConn, o options) error {
+	if err := client.tcp.SetReadDeadline(time.Now().Add(o.proxyProtocolTimeout)); err != nil {
+		return err
+	}
+
+	src, dst, pending, err := readProxyProtocolHeader(client.tcp, o.acceptProxyProtocol == acceptProxyProtocolRequired)
+	if err != nil {
+		proxyProtocolErrors.With(p.labels).Inc()
+		return fmt.Errorf("error reading PROXY protocol header: %s", err)
+	}
+
+	if err := client.tcp.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	if src != nil {
+		client.remote = src
+		client.local = dst
+	}
+
+	client.pending = pending
+
+	return nil
+}
+
+// connect tries upstreams in order until one of them accepts connection,
+// the number of attempts and time spent are limited by connect options
+func (p *proxy) connect(client *clientConn, upstreams Upstreams, o options) (halfCloser, Upstream, error) {
+	p.mutex.Lock()
+	outliers := p.outliers
+	clientTLS := p.clientTLS
+	total := len(p.upstreams)
 	p.mutex.Unlock()
 
-	// TODO: proper iterator accounting weights and current # of connections
-	for i := range upstreams {
-		j := rand.Intn(i + 1)
-		upstreams[i], upstreams[j] = upstreams[j], upstreams[i]
+	dialer := net.Dialer{Timeout: o.connect.timeout}
+	if o.connect.deadline > 0 {
+		dialer.Deadline = time.Now().Add(o.connect.deadline)
 	}
 
+	attempts := 0
+	defer func() {
+		connectAttempts.With(p.labels).Observe(float64(attempts))
+	}()
+
 	for _, upstream := range upstreams {
-		p.log(fmt.Sprintf("connecting from %s to %s", client.RemoteAddr(), upstream))
-		backend, err := net.Dial("tcp", upstream.Addr())
+		if o.connect.attempts > 0 && attempts == o.connect.attempts {
+			break
+		}
+
+		if attempts > 0 && !o.connect.wait(attempts, dialer.Deadline) {
+			break
+		}
+
+		attempts++
+
+		p.log(fmt.Sprintf("connecting from %s to %s", client, upstream))
+		backend, err := p.dial(dialer, client, upstream, o, clientTLS)
 		if err != nil {
 			p.log(fmt.Sprintf("error connecting from %s to %s: %s", client.RemoteAddr(), upstream.Addr(), err))
 			connectionErrors.With(prometheus.Labels{"app": p.app, "upstream": upstream.Addr()}).Inc()
+			if outliers != nil {
+				outliers.failure(upstream, total)
+			}
 			continue
 		}
 
-		p.proxyLoop(client, backend.(*net.TCPConn))
+		if outliers != nil {
+			outliers.success(upstream)
+		}
 
-		break
+		return backend, upstream, nil
 	}
+
+	return nil, Upstream{}, fmt.Errorf("no upstream accepted connection after %d attempts", attempts)
 }
 
-// https://github.com/docker/docker/blob/18c7c67308bd4a24a41028e63c2603bb74eac85e/pkg/proxy/tcp_proxy.go#L34
-func (p *proxy) proxyLoop(client, backend *net.TCPConn) {
-	if err := client.SetKeepAlive(true); err != nil {
-		p.log(fmt.Sprintf("failed to enable keepalive for client %s: %s", client.RemoteAddr(), err))
+// dial connects to an upstream and prepares the connection for proxying,
+// sending PROXY protocol header and performing TLS handshake if needed
+func (p *proxy) dial(dialer net.Dialer, client net.Conn, upstream Upstream, o options, clientTLS *tls.Config) (halfCloser, error) {
+	conn, err := dialer.Dial("tcp", upstream.Addr())
+	if err != nil {
+		return nil, err
 	}
 
+	backend := conn.(*net.TCPConn)
+
 	if err := backend.SetKeepAlive(true); err != nil {
 		p.log(fmt.Sprintf("failed to enable keepalive for backend %s: %s", backend.RemoteAddr(), err))
 	}
 
+	if o.proxyProtocol != "" {
+		header, err := proxyProtocolHeader(o.proxyProtocol, client.RemoteAddr(), client.LocalAddr())
+		if err == nil {
+			_, err = backend.Write(header)
+		}
+
+		if err != nil {
+			_ = backend.Close()
+			return nil, fmt.Errorf("error sending PROXY protocol header: %s", err)
+		}
+	}
+
+	if clientTLS == nil {
+		return backend, nil
+	}
+
+	secure, err := upstreamHandshake(backend, upstream, clientTLS, handshakeDeadline(dialer))
+	if err != nil {
+		_ = backend.Close()
+		return nil, fmt.Errorf("error in TLS handshake: %s", err)
+	}
+
+	return &tlsConn{Conn: secure, tcp: backend}, nil
+}
+
+// https://github.com/docker/docker/blob/18c7c67308bd4a24a41028e63c2603bb74eac85e/pkg/proxy/tcp_proxy.go#L34
+func (p *proxy) proxyLoop(client *clientConn, backend halfCloser, o options, record *connection) {
+	if err := client.tcp.SetKeepAlive(true); err != nil {
+		p.log(fmt.Sprintf("failed to enable keepalive for client %s: %s", client.RemoteAddr(), err))
+	}
+
 	event := make(chan struct{})
-	var broker = func(to, from *net.TCPConn, c prometheus.Counter) {
-		for {
-			n, err := io.CopyN(to, from, copySize)
-			c.Add(float64(n))
-			if err != nil {
-				// If the socket we are writing to is shutdown with
-				// SHUT_WR, forward it to the other end of the pipe:
-				if err, ok := err.(*net.OpError); ok && err.Err == syscall.EPIPE {
-					_ = from.CloseWrite()
-				}
+	activity := record.activity
+	var broker = func(to, from halfCloser, account *byteAccount) {
+		var err error
+		if tcpTo, tcpFrom, ok := spliceable(to, from); ok && o.splice {
+			err = spliceCopy(tcpTo, tcpFrom, o.bufferSize, account.transferred)
+		} else {
+			err = bufferedCopy(to, from, o.bufferSize, account.transferred)
+		}
 
-				break
+		account.flush()
+
+		if err != nil {
+			// If the socket we are writing to is shutdown with
+			// SHUT_WR, forward it to the other end of the pipe:
+			if err, ok := err.(*net.OpError); ok && err.Err == syscall.EPIPE {
+				_ = from.CloseWrite()
 			}
 		}
 
-		_ = to.CloseRead()
+		// Half-closed connections are only kept open
+		// when there is a timeout to clean them up
+		if o.timeouts.halfClosed > 0 {
+			_ = to.CloseWrite()
+		} else {
+			_ = to.CloseRead()
+		}
+
 		event <- struct{}{}
 	}
 
 	backendAddr := backend.RemoteAddr().String()
 	labels := prometheus.Labels{"app": p.app, "upstream": backendAddr}
 
-	go broker(client, backend, bytesSent.With(labels))
-	go broker(backend, client, bytesReceived.With(labels))
-
-	for i := 0; i < 2; i++ {
-		<-event
+	if len(client.pending) > 0 {
+		n, err := backend.Write(client.pending)
+		bytesReceived.With(labels).Add(float64(n))
+		atomic.AddInt64(&record.received, int64(n))
+		if err != nil {
+			p.log(fmt.Sprintf("error sending data from %s to %s: %s", client.RemoteAddr(), backend.RemoteAddr(), err))
+			_ = backend.Close()
+			return
+		}
 	}
 
+	sent := newByteAccount(bytesSent.With(labels), activity, &record.sent)
+	received := newByteAccount(bytesReceived.With(labels), activity, &record.received)
+
+	go broker(client.stream(), backend, sent)
+	go broker(backend, client.stream(), received)
+
+	reason := o.timeouts.watch(event, activity, func() {
+		sent.flush()
+		received.flush()
+	}, func() {
+		_ = client.tcp.Close()
+		_ = backend.Close()
+	})
+
 	_ = client.Close()
 	_ = backend.Close()
 
-	p.log(fmt.Sprintf("closed connection from %s to %s", client.RemoteAddr(), backend.RemoteAddr()))
+	if record.wasKilled() {
+		reason = closeKilled
+	}
+
+	connectionsClosed.With(prometheus.Labels{"app": p.app, "reason": reason}).Inc()
+
+	p.log(fmt.Sprintf("closed connection from %s to %s: %s", client, backend.RemoteAddr(), reason))
+}
+
+// spliceable returns both connections as tcp connections if they are,
+// only plain tcp connections can be spliced
+func spliceable(to, from halfCloser) (*net.TCPConn, *net.TCPConn, bool) {
+	tcpTo, ok := to.(*net.TCPConn)
+	if !ok {
+		return nil, nil, false
+	}
+
+	tcpFrom, ok := from.(*net.TCPConn)
+
+	return tcpTo, tcpFrom, ok
+}
+
+// setTLS replaces TLS configs used to terminate client connections
+// and to connect to upstreams if their options changed, nothing
+// is replaced on error, it must be called with mutex held
+func (p *proxy) setTLS(o options) error {
+	serverTLS := p.serverTLS
+	if o.tls != p.options.tls {
+		serverTLS = nil
+		if o.tls.enabled {
+			config, err := newServerTLSConfig(p.app, o.tls)
+			if err != nil {
+				return fmt.Errorf("error loading TLS certificate: %s", err)
+			}
+
+			serverTLS = config
+			p.log(fmt.Sprintf("terminating TLS with certificate from %s", o.tls.path(o.tls.cert)))
+
+			if o.tls.clientCA != "" {
+				p.log(fmt.Sprintf("requiring client certificates signed by %s", o.tls.path(o.tls.clientCA)))
+			}
+		}
+	}
+
+	clientTLS := p.clientTLS
+	if o.upstreamTLS != p.options.upstreamTLS {
+		clientTLS = nil
+		if o.upstreamTLS.enabled {
+			config, err := newUpstreamTLSConfig(p.app, o.upstreamTLS)
+			if err != nil {
+				return fmt.Errorf("error loading upstream TLS settings: %s", err)
+			}
+
+			clientTLS = config
+			p.log("connecting to upstreams over TLS")
+		}
+	}
+
+	p.serverTLS = serverTLS
+	p.clientTLS = clientTLS
+
+	return nil
+}
+
+// setHealthChecker replaces health checker of the proxy,
+// it must be called with mutex held
+func (p *proxy) setHealthChecker(o healthOptions) {
+	if p.health != nil {
+		p.health.stop()
+		p.health = nil
+	}
+
+	if o.interval == 0 {
+		return
+	}
+
+	p.health = newHealthChecker(p.app, o, p.snapshot)
+	go p.health.start()
+
+	p.log(fmt.Sprintf("checking health of upstreams every %s", o.interval))
+}
+
+// setOutlierDetector replaces outlier detector of the proxy,
+// it must be called with mutex held
+func (p *proxy) setOutlierDetector(o outlierOptions) {
+	if p.outliers != nil {
+		p.outliers.stop()
+		p.outliers = nil
+	}
+
+	if o.failures == 0 {
+		return
+	}
+
+	p.outliers = newOutlierDetector(p.app, o)
+
+	p.log(fmt.Sprintf("ejecting upstreams after %d connection errors", o.failures))
+}
+
+// eligible returns whether an upstream can receive new connections,
+// it must be called with mutex held
+func (p *proxy) eligible(upstream Upstream) bool {
+	if p.health != nil && !p.health.healthy(upstream) {
+		return false
+	}
+
+	if p.outliers != nil && p.outliers.ejected(upstream) {
+		return false
+	}
+
+	return true
+}
+
+// snapshot returns a copy of current upstreams
+func (p *proxy) snapshot() Upstreams {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	upstreams := make(Upstreams, len(p.upstreams))
+	copy(upstreams, p.upstreams)
+
+	return upstreams
+}
+
+// candidates returns a copy of upstreams that are eligible for new
+// connections with their current number of active connections, all
+// upstreams that are not taken out of rotation manually are used
+// if none of them are eligible, it must be called with mutex held
+func (p *proxy) candidates() Upstreams {
+	available := make(Upstreams, 0, len(p.upstreams))
+	for _, upstream := range p.upstreams {
+		if p.overrides != nil && p.overrides.mode(upstream) != "" {
+			continue
+		}
+
+		upstream.connections = p.active[upstream.Addr()]
+		available = append(available, upstream)
+	}
+
+	upstreams := make(Upstreams, 0, len(available))
+	for _, upstream := range available {
+		if p.eligible(upstream) {
+			upstreams = append(upstreams, upstream)
+		}
+	}
+
+	if len(upstreams) == 0 && len(available) > 0 {
+		p.log("no eligible upstreams, trying all of them")
+		return available
+	}
+
+	return upstreams
+}
+
+// acquire records a new active connection to an upstream
+func (p *proxy) acquire(upstream Upstream) {
+	p.mutex.Lock()
+	p.active[upstream.Addr()]++
+	p.mutex.Unlock()
+}
+
+// release records a finished connection to an upstream
+func (p *proxy) release(upstream Upstream) {
+	addr := upstream.Addr()
+
+	p.mutex.Lock()
+	if p.active[addr]--; p.active[addr] == 0 {
+		delete(p.active, addr)
+	}
+	p.mutex.Unlock()
+}
+
+// stop closes listeners of the proxy, existing connections stay open
+func (p *proxy) stop() {
+	close(p.done)
+
+	for _, listener := range p.listeners {
+		if err := listener.Close(); err != nil {
+			p.log(fmt.Sprintf("error closing listener on %s: %s", listener.Addr(), err))
+		}
+	}
+
+	p.mutex.Lock()
+	p.setHealthChecker(healthOptions{})
+	p.setOutlierDetector(outlierOptions{})
+	p.mutex.Unlock()
+
+	proxyUpstreams.Delete(p.labels)
+
+	p.log("stopped listening")
+}
+
+// drain waits for active connections to finish until ctx is done
+// and forcibly closes connections that are still open after that
+func (p *proxy) drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+
+	for p.connections() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			p.log(fmt.Sprintf("closing %d connections after drain timeout", p.connections()))
+			p.closeConnections()
+			return ctx.Err()
+		}
+	}
+
+	p.log("all connections are drained")
+
+	return nil
+}
+
+// track registers an active client connection
+func (p *proxy) track(conn net.Conn) *connection {
+	record := newConnection(conn, p.app, p.listen)
+
+	p.mutex.Lock()
+	p.conns[conn] = record
+	p.mutex.Unlock()
+
+	return record
+}
+
+// untrack removes client connection from the list of active ones
+func (p *proxy) untrack(conn net.Conn) {
+	p.mutex.Lock()
+	delete(p.conns, conn)
+	p.mutex.Unlock()
+}
+
+// connections returns the number of active client connections
+func (p *proxy) connections() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return len(p.conns)
+}
+
+// activeConnections returns records of active client connections
+func (p *proxy) activeConnections() []*connection {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	records := make([]*connection, 0, len(p.conns))
+	for _, record := range p.conns {
+		records = append(records, record)
+	}
+
+	return records
+}
+
+// closeConnections closes all active client connections
+func (p *proxy) closeConnections() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for conn := range p.conns {
+		_ = conn.Close()
+	}
 }
 
 func (p *proxy) log(msg string) {
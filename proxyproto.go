@@ -0,0 +1,321 @@
+package zoidbergtcp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// proxyProtocolV1 is the human-readable PROXY protocol version
+	proxyProtocolV1 = "v1"
+
+	// proxyProtocolV2 is the binary PROXY protocol version
+	proxyProtocolV2 = "v2"
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol v2 header
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// acceptProxyProtocolRequired makes listeners reject
+	// connections without PROXY protocol header
+	acceptProxyProtocolRequired = "required"
+
+	// acceptProxyProtocolOptional makes listeners parse PROXY protocol
+	// header if connection starts with it
+	acceptProxyProtocolOptional = "optional"
+)
+
+// proxyProtocolVersions returns supported PROXY protocol versions
+func proxyProtocolVersions() []string {
+	return []string{proxyProtocolV1, proxyProtocolV2}
+}
+
+// proxyProtocolHeader returns PROXY protocol header of the given version
+// that describes a connection from src to dst
+func proxyProtocolHeader(version string, src, dst net.Addr) ([]byte, error) {
+	switch version {
+	case proxyProtocolV1:
+		return proxyProtocolV1Header(src, dst), nil
+	case proxyProtocolV2:
+		return proxyProtocolV2Header(src, dst), nil
+	default:
+		return nil, fmt.Errorf("unknown PROXY protocol version: %q", version)
+	}
+}
+
+// proxyProtocolAddrs returns tcp addresses of both ends of a connection
+// if they are of the same family, ipv4 addresses are returned in 4 bytes
+func proxyProtocolAddrs(src, dst net.Addr) (*net.TCPAddr, *net.TCPAddr, bool) {
+	s, ok := src.(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false
+	}
+
+	d, ok := dst.(*net.TCPAddr)
+	if !ok {
+		return nil, nil, false
+	}
+
+	if s.IP.To4() != nil && d.IP.To4() != nil {
+		return &net.TCPAddr{IP: s.IP.To4(), Port: s.Port}, &net.TCPAddr{IP: d.IP.To4(), Port: d.Port}, true
+	}
+
+	if s.IP.To4() == nil && d.IP.To4() == nil && s.IP.To16() != nil && d.IP.To16() != nil {
+		return s, d, true
+	}
+
+	return nil, nil, false
+}
+
+// proxyProtocolV1Header returns PROXY protocol v1 header
+func proxyProtocolV1Header(src, dst net.Addr) []byte {
+	s, d, ok := proxyProtocolAddrs(src, dst)
+	if !ok {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+
+	family := "TCP6"
+	if len(s.IP) == net.IPv4len {
+		family = "TCP4"
+	}
+
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, s.IP, d.IP, s.Port, d.Port))
+}
+
+// proxyProtocolV2Header returns PROXY protocol v2 header
+func proxyProtocolV2Header(src, dst net.Addr) []byte {
+	header := bytes.NewBuffer(append([]byte{}, proxyProtocolV2Signature...))
+
+	// version 2, PROXY command
+	header.WriteByte(0x21)
+
+	s, d, ok := proxyProtocolAddrs(src, dst)
+	if !ok {
+		// unspecified family, no addresses
+		header.Write([]byte{0x00, 0x00, 0x00})
+		return header.Bytes()
+	}
+
+	family := byte(0x21) // TCP over IPv6
+	if len(s.IP) == net.IPv4len {
+		family = 0x11 // TCP over IPv4
+	}
+
+	header.WriteByte(family)
+
+	_ = binary.Write(header, binary.BigEndian, uint16(2*len(s.IP)+4))
+
+	header.Write(s.IP)
+	header.Write(d.IP)
+
+	_ = binary.Write(header, binary.BigEndian, uint16(s.Port))
+	_ = binary.Write(header, binary.BigEndian, uint16(d.Port))
+
+	return header.Bytes()
+}
+
+// defaultProxyProtocolTimeout is the default time
+// for clients to send PROXY protocol header
+const defaultProxyProtocolTimeout = 5 * time.Second
+
+// proxyProtocolV1Prefix starts every PROXY protocol v1 header
+var proxyProtocolV1Prefix = []byte("PROXY ")
+
+// proxyProtocolV1MaxLength is the maximum length of PROXY protocol v1 header
+const proxyProtocolV1MaxLength = 107
+
+// readProxyProtocolHeader reads PROXY protocol header from a connection
+// and returns original source and destination addresses, which are nil
+// if the header does not carry them, data read from the connection past
+// the header or instead of it when the header is not required and the
+// connection does not start with it is returned as pending to be
+// forwarded to the upstream
+func readProxyProtocolHeader(conn net.Conn, required bool) (net.Addr, net.Addr, []byte, error) {
+	reader := bufio.NewReader(conn)
+
+	version, err := detectProxyProtocol(reader)
+	if err != nil {
+		// clients of server-first protocols send nothing
+		if e, ok := err.(net.Error); ok && e.Timeout() && !required && reader.Buffered() == 0 {
+			return nil, nil, nil, nil
+		}
+
+		return nil, nil, nil, err
+	}
+
+	var src, dst net.Addr
+
+	switch version {
+	case proxyProtocolV1:
+		src, dst, err = readProxyProtocolV1Header(reader)
+	case proxyProtocolV2:
+		src, dst, err = readProxyProtocolV2Header(reader)
+	default:
+		if required {
+			err = fmt.Errorf("connection does not start with PROXY protocol header")
+		}
+	}
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return src, dst, buffered(reader), nil
+}
+
+// detectProxyProtocol returns version of PROXY protocol header the reader
+// starts with without consuming it, empty version means no header, data
+// is read as it arrives, so clients sending less than a header are fine
+func detectProxyProtocol(reader *bufio.Reader) (string, error) {
+	for n := 1; ; n = reader.Buffered() + 1 {
+		if _, err := reader.Peek(n); err != nil {
+			return "", err
+		}
+
+		data, _ := reader.Peek(reader.Buffered())
+
+		switch {
+		case bytes.HasPrefix(data, proxyProtocolV1Prefix):
+			return proxyProtocolV1, nil
+		case bytes.HasPrefix(data, proxyProtocolV2Signature):
+			return proxyProtocolV2, nil
+		case !bytes.HasPrefix(proxyProtocolV1Prefix, data) && !bytes.HasPrefix(proxyProtocolV2Signature, data):
+			return "", nil
+		}
+	}
+}
+
+// buffered returns a copy of data buffered by the reader
+func buffered(reader *bufio.Reader) []byte {
+	if reader.Buffered() == 0 {
+		return nil
+	}
+
+	data, _ := reader.Peek(reader.Buffered())
+
+	return append([]byte{}, data...)
+}
+
+// readProxyProtocolV1Header reads PROXY protocol v1 header
+func readProxyProtocolV1Header(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := []byte{}
+
+	for !bytes.HasSuffix(header, []byte("\r\n")) {
+		if len(header) == proxyProtocolV1MaxLength {
+			return nil, nil, fmt.Errorf("PROXY protocol v1 header is too long")
+		}
+
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		header = append(header, b)
+	}
+
+	fields := strings.Fields(string(header))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("malformed PROXY protocol v1 header: %q", header)
+	}
+
+	src, err := parseProxyProtocolV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dst, err := parseProxyProtocolV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return src, dst, nil
+}
+
+// parseProxyProtocolV1Addr parses address from PROXY protocol v1 header
+func parseProxyProtocolV1Addr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 address: %q", host)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 port: %q", port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyProtocolV2Header reads PROXY protocol v2 header
+func readProxyProtocolV2Header(reader *bufio.Reader) (net.Addr, net.Addr, error) {
+	if _, err := reader.Discard(len(proxyProtocolV2Signature)); err != nil {
+		return nil, nil, err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, err
+	}
+
+	if header[0]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol version: %d", header[0]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, nil, err
+	}
+
+	switch header[0] & 0xf {
+	case 0x0:
+		// LOCAL command, connection was made by the balancer itself
+		return nil, nil, nil
+	case 0x1:
+		return parseProxyProtocolV2Addrs(header[1], payload)
+	default:
+		return nil, nil, fmt.Errorf("unsupported PROXY protocol v2 command: %d", header[0]&0xf)
+	}
+}
+
+// parseProxyProtocolV2Addrs parses addresses from PROXY protocol v2 payload,
+// families other than tcp over ipv4 and ipv6 carry no usable addresses
+func parseProxyProtocolV2Addrs(family byte, payload []byte) (net.Addr, net.Addr, error) {
+	size := 0
+
+	switch family {
+	case 0x11:
+		size = net.IPv4len
+	case 0x21:
+		size = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+
+	if len(payload) < 2*size+4 {
+		return nil, nil, fmt.Errorf("PROXY protocol v2 addresses are too short: %d bytes", len(payload))
+	}
+
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size:])),
+	}
+
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(payload[2*size+2:])),
+	}
+
+	return src, dst, nil
+}
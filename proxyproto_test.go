@@ -0,0 +1,278 @@
+package zoidbergtcp
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyProtocolTestTimeout is the time given to tests
+// to send PROXY protocol headers
+const proxyProtocolTestTimeout = 100 * time.Millisecond
+
+// serveProxyProtocol reads PROXY protocol header from a connection that
+// receives data, the connection is closed after data is sent unless it
+// is silent, split data is sent one byte at a time
+func serveProxyProtocol(data []byte, required, silent, split bool) (net.Addr, net.Addr, []byte, error) {
+	client, server := net.Pipe()
+
+	defer func() {
+		_ = server.Close()
+	}()
+
+	go func() {
+		if silent {
+			return
+		}
+
+		defer func() {
+			_ = client.Close()
+		}()
+
+		if !split {
+			_, _ = client.Write(data)
+			return
+		}
+
+		for i := range data {
+			if _, err := client.Write(data[i : i+1]); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := server.SetReadDeadline(time.Now().Add(proxyProtocolTestTimeout)); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return readProxyProtocolHeader(server, required)
+}
+
+// addrString returns string representation of an address, empty for nil
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	return addr.String()
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	tcp4src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51000}
+	tcp4dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+	tcp6src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51000}
+	tcp6dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+	unix := &net.UnixAddr{Name: "/tmp/socket", Net: "unix"}
+
+	v2tcp4 := proxyProtocolV2Header(tcp4src, tcp4dst)
+	signature := string(proxyProtocolV2Signature)
+
+	cases := []struct {
+		name     string
+		data     string
+		required bool
+		silent   bool
+		split    bool
+		src      string
+		dst      string
+		pending  string
+		err      bool
+	}{
+		{
+			name:    "v1 tcp4",
+			data:    "PROXY TCP4 192.0.2.1 198.51.100.1 51000 443\r\nhello",
+			src:     "192.0.2.1:51000",
+			dst:     "198.51.100.1:443",
+			pending: "hello",
+		},
+		{
+			name:    "v1 tcp6",
+			data:    "PROXY TCP6 2001:db8::1 2001:db8::2 51000 443\r\nhello",
+			src:     "[2001:db8::1]:51000",
+			dst:     "[2001:db8::2]:443",
+			pending: "hello",
+		},
+		{
+			name:    "v1 unknown",
+			data:    "PROXY UNKNOWN\r\nhello",
+			pending: "hello",
+		},
+		{
+			name:  "v1 split",
+			data:  "PROXY TCP4 192.0.2.1 198.51.100.1 51000 443\r\n",
+			split: true,
+			src:   "192.0.2.1:51000",
+			dst:   "198.51.100.1:443",
+		},
+		{
+			name: "v1 truncated",
+			data: "PROXY TCP4 192.0.2.1 198.51.100.1",
+			err:  true,
+		},
+		{
+			name: "v1 oversized",
+			data: "PROXY TCP4 " + strings.Repeat("1", proxyProtocolV1MaxLength) + "\r\n",
+			err:  true,
+		},
+		{
+			name: "v1 missing port",
+			data: "PROXY TCP4 192.0.2.1 198.51.100.1 51000\r\n",
+			err:  true,
+		},
+		{
+			name: "v1 unsupported family",
+			data: "PROXY UDP4 192.0.2.1 198.51.100.1 51000 443\r\n",
+			err:  true,
+		},
+		{
+			name: "v1 malformed address",
+			data: "PROXY TCP4 192.0.2 198.51.100.1 51000 443\r\n",
+			err:  true,
+		},
+		{
+			name: "v1 port out of range",
+			data: "PROXY TCP4 192.0.2.1 198.51.100.1 51000 65536\r\n",
+			err:  true,
+		},
+		{
+			name:    "v2 tcp4",
+			data:    string(v2tcp4) + "hello",
+			src:     "192.0.2.1:51000",
+			dst:     "198.51.100.1:443",
+			pending: "hello",
+		},
+		{
+			name:    "v2 tcp6",
+			data:    string(proxyProtocolV2Header(tcp6src, tcp6dst)) + "hello",
+			src:     "[2001:db8::1]:51000",
+			dst:     "[2001:db8::2]:443",
+			pending: "hello",
+		},
+		{
+			name:  "v2 split",
+			data:  string(v2tcp4),
+			split: true,
+			src:   "192.0.2.1:51000",
+			dst:   "198.51.100.1:443",
+		},
+		{
+			name:    "v2 unspecified family",
+			data:    string(proxyProtocolV2Header(unix, unix)) + "hello",
+			pending: "hello",
+		},
+		{
+			name:    "v2 local",
+			data:    signature + "\x20\x11\x00\x0c" + string(v2tcp4[16:]) + "hello",
+			pending: "hello",
+		},
+		{
+			name: "v2 truncated signature",
+			data: signature[:8],
+			err:  true,
+		},
+		{
+			name: "v2 truncated addresses",
+			data: string(v2tcp4[:len(v2tcp4)-2]),
+			err:  true,
+		},
+		{
+			name: "v2 short addresses",
+			data: signature + "\x21\x11\x00\x04\xc0\x00\x02\x01",
+			err:  true,
+		},
+		{
+			name: "v2 unsupported version",
+			data: signature + "\x11\x11\x00\x0c" + string(v2tcp4[16:]),
+			err:  true,
+		},
+		{
+			name: "v2 unsupported command",
+			data: signature + "\x22\x11\x00\x0c" + string(v2tcp4[16:]),
+			err:  true,
+		},
+		{
+			name:    "no header",
+			data:    "EHLO example.com\r\n",
+			pending: "EHLO example.com\r\n",
+		},
+		{
+			name:    "no header sharing prefix",
+			data:    "PROXIMITY",
+			pending: "PROXIMITY",
+		},
+		{
+			name:     "no header required",
+			data:     "EHLO example.com\r\n",
+			required: true,
+			err:      true,
+		},
+		{
+			name:   "silent client",
+			silent: true,
+		},
+		{
+			name:     "silent client required",
+			silent:   true,
+			required: true,
+			err:      true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			src, dst, pending, err := serveProxyProtocol([]byte(c.data), c.required, c.silent, c.split)
+			if c.err {
+				if err == nil {
+					t.Fatalf("expected error, got src %q, dst %q", addrString(src), addrString(dst))
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if addrString(src) != c.src {
+				t.Errorf("expected src %q, got %q", c.src, addrString(src))
+			}
+
+			if addrString(dst) != c.dst {
+				t.Errorf("expected dst %q, got %q", c.dst, addrString(dst))
+			}
+
+			if !bytes.Equal(pending, []byte(c.pending)) {
+				t.Errorf("expected pending %q, got %q", c.pending, pending)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolHeaderRoundTrip(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51000}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+
+	for _, version := range proxyProtocolVersions() {
+		t.Run(version, func(t *testing.T) {
+			header, err := proxyProtocolHeader(version, src, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s, d, pending, err := serveProxyProtocol(header, true, false, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if addrString(s) != src.String() || addrString(d) != dst.String() {
+				t.Errorf("expected %s -> %s, got %s -> %s", src, dst, addrString(s), addrString(d))
+			}
+
+			if len(pending) != 0 {
+				t.Errorf("expected nothing pending, got %q", pending)
+			}
+		})
+	}
+}
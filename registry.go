@@ -0,0 +1,248 @@
+package zoidbergtcp
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// closeKilled means that the connection was closed through management API
+const closeKilled = "killed"
+
+// connectionIDs generates identifiers of client connections
+var connectionIDs uint64
+
+// connection holds details of an active client connection
+type connection struct {
+	mutex    sync.Mutex
+	id       uint64
+	conn     net.Conn
+	app      string
+	listen   string
+	client   net.Addr
+	identity string
+	upstream string
+	started  time.Time
+	activity *activity
+	sent     int64
+	received int64
+	killed   int32
+}
+
+// newConnection creates a record of an accepted client connection
+func newConnection(conn net.Conn, app, listen string) *connection {
+	return &connection{
+		mutex:    sync.Mutex{},
+		id:       atomic.AddUint64(&connectionIDs, 1),
+		conn:     conn,
+		app:      app,
+		listen:   listen,
+		client:   conn.RemoteAddr(),
+		started:  time.Now(),
+		activity: newActivity(),
+	}
+}
+
+// accepted records the original address and identity of the client
+func (c *connection) accepted(client *clientConn) {
+	c.mutex.Lock()
+	c.client = client.RemoteAddr()
+	c.identity = client.identity
+	c.mutex.Unlock()
+}
+
+// connected records the upstream the client is connected to
+func (c *connection) connected(upstream Upstream) {
+	c.mutex.Lock()
+	c.upstream = upstream.Addr()
+	c.mutex.Unlock()
+}
+
+// kill closes the connection
+func (c *connection) kill() {
+	atomic.StoreInt32(&c.killed, 1)
+	_ = c.conn.Close()
+}
+
+// wasKilled returns whether the connection was closed by kill
+func (c *connection) wasKilled() bool {
+	return atomic.LoadInt32(&c.killed) == 1
+}
+
+// info describes the connection
+func (c *connection) info() ConnectionInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return ConnectionInfo{
+		ID:            c.id,
+		App:           c.app,
+		Listen:        c.listen,
+		Client:        c.client.String(),
+		Identity:      c.identity,
+		Upstream:      c.upstream,
+		Started:       c.started,
+		BytesSent:     atomic.LoadInt64(&c.sent),
+		BytesReceived: atomic.LoadInt64(&c.received),
+		Idle:          c.activity.since().Seconds(),
+	}
+}
+
+// ConnectionInfo describes an active client connection, bytes are
+// counted from the client point of view, idle time is in seconds
+type ConnectionInfo struct {
+	ID            uint64    `json:"id"`
+	App           string    `json:"app"`
+	Listen        string    `json:"listen"`
+	Client        string    `json:"client"`
+	Identity      string    `json:"identity,omitempty"`
+	Upstream      string    `json:"upstream"`
+	Started       time.Time `json:"started"`
+	BytesSent     int64     `json:"bytes_sent"`
+	BytesReceived int64     `json:"bytes_received"`
+	Idle          float64   `json:"idle"`
+}
+
+// ConnectionFilter selects client connections, empty fields match
+// any connection, upstream matches either host or host:port
+type ConnectionFilter struct {
+	ID       uint64
+	App      string
+	Upstream string
+	Client   *net.IPNet
+}
+
+// ParseConnectionFilter creates a filter from query parameters:
+// id, app, upstream and client, where client is an address or CIDR
+func ParseConnectionFilter(query url.Values) (ConnectionFilter, error) {
+	filter := ConnectionFilter{
+		App:      query.Get("app"),
+		Upstream: query.Get("upstream"),
+	}
+
+	if id := query.Get("id"); id != "" {
+		var err error
+		if filter.ID, err = strconv.ParseUint(id, 10, 64); err != nil {
+			return filter, fmt.Errorf("invalid id: %q", id)
+		}
+	}
+
+	if client := query.Get("client"); client != "" {
+		if !strings.Contains(client, "/") {
+			if strings.Contains(client, ":") {
+				client += "/128"
+			} else {
+				client += "/32"
+			}
+		}
+
+		_, cidr, err := net.ParseCIDR(client)
+		if err != nil {
+			return filter, fmt.Errorf("invalid client: %s", err)
+		}
+
+		filter.Client = cidr
+	}
+
+	return filter, nil
+}
+
+// Empty returns whether the filter matches all connections
+func (f ConnectionFilter) Empty() bool {
+	return f.ID == 0 && f.App == "" && f.Upstream == "" && f.Client == nil
+}
+
+// matches returns whether connection matches the filter
+func (f ConnectionFilter) matches(info ConnectionInfo) bool {
+	if f.ID != 0 && info.ID != f.ID {
+		return false
+	}
+
+	if f.App != "" && info.App != f.App {
+		return false
+	}
+
+	if f.Upstream != "" && info.Upstream != f.Upstream && !strings.HasPrefix(info.Upstream, f.Upstream+":") {
+		return false
+	}
+
+	if f.Client == nil {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(info.Client)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && f.Client.Contains(ip)
+}
+
+// Connections returns active client connections matching the filter
+func (m *Manager) Connections(filter ConnectionFilter) []ConnectionInfo {
+	infos := []ConnectionInfo{}
+	for _, c := range m.matchingConnections(filter) {
+		infos = append(infos, c.info())
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+
+	return infos
+}
+
+// KillConnections closes active client connections matching
+// the filter and returns descriptions of closed connections
+func (m *Manager) KillConnections(filter ConnectionFilter) []ConnectionInfo {
+	infos := []ConnectionInfo{}
+	for _, c := range m.matchingConnections(filter) {
+		infos = append(infos, c.info())
+		c.kill()
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+
+	return infos
+}
+
+// matchingConnections returns connections of all proxies matching the filter
+func (m *Manager) matchingConnections(filter ConnectionFilter) []*connection {
+	m.mutex.Lock()
+
+	proxies := make([]*proxy, 0, len(m.proxies)+len(m.draining))
+	for _, proxy := range m.proxies {
+		proxies = append(proxies, proxy)
+	}
+
+	for _, router := range m.routers {
+		proxies = append(proxies, router.all()...)
+	}
+
+	for proxy := range m.draining {
+		proxies = append(proxies, proxy)
+	}
+
+	m.mutex.Unlock()
+
+	matching := []*connection{}
+	for _, proxy := range proxies {
+		for _, c := range proxy.activeConnections() {
+			if filter.matches(c.info()) {
+				matching = append(matching, c)
+			}
+		}
+	}
+
+	return matching
+}
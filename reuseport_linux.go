@@ -0,0 +1,22 @@
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package zoidbergtcp
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT socket option that is missing in syscall
+const soReusePort = 0xf
+
+// reusePortControl enables SO_REUSEPORT on a socket before it is bound
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+
+	if e := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); e != nil {
+		return e
+	}
+
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+// +build !linux mips mipsle mips64 mips64le
+
+package zoidbergtcp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortControl fails since SO_REUSEPORT is not supported on this platform
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
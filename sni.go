@@ -0,0 +1,394 @@
+package zoidbergtcp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sniReadTimeout is the time for clients to send TLS ClientHello
+// on listen addresses shared by several apps
+const sniReadTimeout = 5 * time.Second
+
+var sniErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "zoidberg_proxy_sni_errors",
+		Help: "number of client connections on shared listen addresses that were not routed to any app by reason",
+	},
+	[]string{"listen", "reason"},
+)
+
+func init() {
+	prometheus.MustRegister(sniErrors)
+}
+
+// errHelloRead is returned to stop TLS handshake after ClientHello is read
+var errHelloRead = errors.New("client hello is read")
+
+// sniRouted returns whether an app shares its listen address with other
+// apps and receives connections based on TLS server name
+func sniRouted(meta map[string]string) bool {
+	fallback, _ := strconv.ParseBool(meta["sni_default"])
+	return meta["sni"] != "" || fallback
+}
+
+// router accepts connections on a listen address shared by several apps
+// and hands them over to proxies of apps based on TLS server name
+type router struct {
+	mutex     sync.Mutex
+	listen    string
+	listeners []net.Listener
+	proxies   map[string]*proxy
+	names     map[string]*proxy
+	fallback  *proxy
+	started   bool
+	done      chan struct{}
+}
+
+// newRouter creates a new router, inherited listeners
+// are used instead of creating new ones if there are any
+func newRouter(listen string, sockets int, inherited []net.Listener) (*router, error) {
+	listeners := inherited
+	if len(listeners) == 0 {
+		var err error
+		if listeners, err = listenAll(listen, sockets); err != nil {
+			return nil, err
+		}
+	}
+
+	return &router{
+		mutex:     sync.Mutex{},
+		listen:    listen,
+		listeners: listeners,
+		proxies:   map[string]*proxy{},
+		names:     map[string]*proxy{},
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// get returns proxy of an app, nil if there is none
+func (r *router) get(app string) *proxy {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.proxies[app]
+}
+
+// all returns proxies of all apps
+func (r *router) all() []*proxy {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	proxies := make([]*proxy, 0, len(r.proxies))
+	for _, p := range r.proxies {
+		proxies = append(proxies, p)
+	}
+
+	return proxies
+}
+
+// set adds or replaces proxy of an app, routes
+// are not updated until rebuild is called
+func (r *router) set(p *proxy) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.proxies[p.app] = p
+}
+
+// remove removes proxy of an app and its routes
+func (r *router) remove(app string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	p, ok := r.proxies[app]
+	if !ok {
+		return
+	}
+
+	delete(r.proxies, app)
+
+	for name, routed := range r.names {
+		if routed == p {
+			delete(r.names, name)
+		}
+	}
+
+	if r.fallback == p {
+		r.fallback = nil
+	}
+}
+
+// rebuild builds routing table from server names of proxies, apps keep
+// server names and default route they already have while they still
+// claim them, new claims are processed in order of app names and the
+// first one gets a server name, apps that lost server names are returned
+func (r *router) rebuild() []Conflict {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	apps := make([]string, 0, len(r.proxies))
+	for app := range r.proxies {
+		apps = append(apps, app)
+	}
+
+	sort.Strings(apps)
+
+	r.keepRoutes(apps)
+
+	return r.claimRoutes(apps)
+}
+
+// keepRoutes leaves only routes that still belong to their apps,
+// it must be called with mutex held
+func (r *router) keepRoutes(apps []string) {
+	names, fallback := r.names, r.fallback
+
+	r.names = map[string]*proxy{}
+	r.fallback = nil
+
+	for _, app := range apps {
+		p := r.proxies[app]
+		o := p.currentOptions()
+
+		for _, name := range serverNames(o.sni) {
+			if owner, ok := names[name]; ok && owner.app == app {
+				r.names[name] = p
+			}
+		}
+
+		if o.sniDefault && fallback != nil && fallback.app == app {
+			r.fallback = p
+		}
+	}
+}
+
+// claimRoutes assigns server names and default route that are not taken
+// yet and returns conflicts, it must be called with mutex held
+func (r *router) claimRoutes(apps []string) []Conflict {
+	conflicts := []Conflict{}
+
+	for _, app := range apps {
+		p := r.proxies[app]
+		o := p.currentOptions()
+
+		for _, name := range serverNames(o.sni) {
+			if owner, ok := r.names[name]; ok {
+				if owner != p {
+					conflicts = append(conflicts, r.conflict(app, name, owner))
+				}
+
+				continue
+			}
+
+			r.names[name] = p
+		}
+
+		if !o.sniDefault {
+			continue
+		}
+
+		if r.fallback != nil && r.fallback != p {
+			conflicts = append(conflicts, r.conflict(app, "*", r.fallback))
+			continue
+		}
+
+		r.fallback = p
+	}
+
+	return conflicts
+}
+
+// serverNames returns normalized server names from sni option
+func serverNames(sni string) []string {
+	names := []string{}
+	for _, name := range strings.Split(sni, ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// conflict describes an app that claims server name of another app,
+// default route is described with "*" as the server name
+func (r *router) conflict(app, name string, owner *proxy) Conflict {
+	return Conflict{Listen: r.listen, ServerName: name, App: app, Owner: owner.app}
+}
+
+// lookup returns proxy for a server name, exact names take precedence
+// over wildcards, which take precedence over default route
+func (r *router) lookup(name string) *proxy {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	if p, ok := r.names[name]; ok {
+		return p
+	}
+
+	if i := strings.Index(name, "."); i > 0 {
+		if p, ok := r.names["*"+name[i:]]; ok {
+			return p
+		}
+	}
+
+	return r.fallback
+}
+
+// empty returns whether there are no apps left on the router
+func (r *router) empty() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return len(r.proxies) == 0
+}
+
+// start starts accepting connections
+func (r *router) start() {
+	r.started = true
+
+	for _, listener := range r.listeners {
+		go func(listener net.Listener) {
+			r.log(fmt.Sprintf("started listening on %s", listener.Addr()))
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					select {
+					case <-r.done:
+						return
+					default:
+					}
+
+					r.log(fmt.Sprintf("error on accepting: %s", err))
+					continue
+				}
+
+				go r.route(conn.(*net.TCPConn))
+			}
+		}(listener)
+	}
+}
+
+// route reads TLS ClientHello from a connection and hands the connection
+// over to the proxy of the app serving requested server name
+func (r *router) route(conn *net.TCPConn) {
+	name, hello, err := readServerName(conn)
+	if err != nil {
+		reason := "not_tls"
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			reason = "timeout"
+		}
+
+		sniErrors.With(prometheus.Labels{"listen": r.listen, "reason": reason}).Inc()
+		r.log(fmt.Sprintf("error reading server name from %s: %s", conn.RemoteAddr(), err))
+		_ = conn.Close()
+		return
+	}
+
+	p := r.lookup(name)
+	if p == nil {
+		sniErrors.With(prometheus.Labels{"listen": r.listen, "reason": "no_route"}).Inc()
+		r.log(fmt.Sprintf("no app serves server name %q requested by %s", name, conn.RemoteAddr()))
+		_ = conn.Close()
+		return
+	}
+
+	connectionsAccepted.With(p.labels).Inc()
+
+	p.serve(conn, hello)
+}
+
+// stop closes listeners of the router, proxies are stopped separately
+func (r *router) stop() {
+	close(r.done)
+
+	for _, listener := range r.listeners {
+		if err := listener.Close(); err != nil {
+			r.log(fmt.Sprintf("error closing listener on %s: %s", listener.Addr(), err))
+		}
+	}
+
+	r.log("stopped listening")
+}
+
+func (r *router) log(msg string) {
+	log.Printf("router[listen=%s]: %s", r.listen, msg)
+}
+
+// readServerName reads TLS ClientHello from a connection and returns
+// requested server name along with the data read from the connection
+func readServerName(conn net.Conn) (string, []byte, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(sniReadTimeout)); err != nil {
+		return "", nil, err
+	}
+
+	hello := &bytes.Buffer{}
+	name := ""
+
+	server := tls.Server(readOnlyConn{reader: io.TeeReader(conn, hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = info.ServerName
+			return nil, errHelloRead
+		},
+	})
+
+	if err := server.Handshake(); !errors.Is(err, errHelloRead) {
+		if e, ok := err.(net.Error); ok && e.Timeout() {
+			return "", nil, e
+		}
+
+		return "", nil, fmt.Errorf("error reading TLS ClientHello: %s", err)
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return "", nil, err
+	}
+
+	return name, hello.Bytes(), nil
+}
+
+// readOnlyConn is a connection that can only be read from,
+// it is used to read TLS ClientHello without responding to it
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+// Read reads from the underlying reader
+func (c readOnlyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// Write discards data, nothing is written during ClientHello reading
+func (c readOnlyConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// SetDeadline does nothing, deadline is set on the real connection
+func (c readOnlyConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+// SetReadDeadline does nothing, deadline is set on the real connection
+func (c readOnlyConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline does nothing, nothing is written
+func (c readOnlyConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
@@ -0,0 +1,206 @@
+package zoidbergtcp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// clientHello returns TLS ClientHello record sent by a client
+// connecting to a server name, no server name is sent if it is empty
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+
+	defer func() {
+		_ = server.Close()
+	}()
+
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		_ = client.Close()
+	}()
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		t.Fatal(err)
+	}
+
+	return append(header, body...)
+}
+
+func TestReadServerName(t *testing.T) {
+	named := clientHello(t, "a.example.com")
+
+	cases := []struct {
+		name       string
+		data       []byte
+		serverName string
+		err        bool
+	}{
+		{
+			name:       "with server name",
+			data:       named,
+			serverName: "a.example.com",
+		},
+		{
+			name: "without server name",
+			data: clientHello(t, ""),
+		},
+		{
+			name: "truncated",
+			data: named[:len(named)/2],
+			err:  true,
+		},
+		{
+			name: "not tls",
+			data: []byte("GET / HTTP/1.1\r\nHost: a.example.com\r\n\r\n"),
+			err:  true,
+		},
+		{
+			name: "empty",
+			err:  true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, server := net.Pipe()
+
+			defer func() {
+				_ = server.Close()
+			}()
+
+			go func() {
+				_, _ = client.Write(c.data)
+				_ = client.Close()
+			}()
+
+			name, pending, err := readServerName(server)
+			if c.err {
+				if err == nil {
+					t.Fatalf("expected error, got server name %q", name)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if name != c.serverName {
+				t.Errorf("expected server name %q, got %q", c.serverName, name)
+			}
+
+			if !bytes.Equal(pending, c.data) {
+				t.Errorf("expected ClientHello to be returned as pending, got %d bytes out of %d", len(pending), len(c.data))
+			}
+		})
+	}
+}
+
+func TestRouterLookup(t *testing.T) {
+	exact := newRoutedProxy("exact", "127.0.0.1:443")
+	wildcard := newRoutedProxy("wildcard", "127.0.0.1:443")
+	fallback := newRoutedProxy("fallback", "127.0.0.1:443")
+
+	names := map[string]*proxy{
+		"a.example.com": exact,
+		"*.example.com": wildcard,
+	}
+
+	cases := []struct {
+		name     string
+		fallback *proxy
+		expected *proxy
+	}{
+		{name: "a.example.com", fallback: fallback, expected: exact},
+		{name: "A.Example.COM.", fallback: fallback, expected: exact},
+		{name: "b.example.com", fallback: fallback, expected: wildcard},
+		{name: "c.b.example.com", fallback: fallback, expected: fallback},
+		{name: "example.com", fallback: fallback, expected: fallback},
+		{name: "", fallback: fallback, expected: fallback},
+		{name: "b.example.org", fallback: nil, expected: nil},
+	}
+
+	for _, c := range cases {
+		r := &router{names: names, fallback: c.fallback}
+
+		if p := r.lookup(c.name); p != c.expected {
+			t.Errorf("lookup of %q: expected %s, got %s", c.name, appOf(c.expected), appOf(p))
+		}
+	}
+}
+
+// appOf returns app of a proxy, empty for nil
+func appOf(p *proxy) string {
+	if p == nil {
+		return ""
+	}
+
+	return p.app
+}
+
+// routedProxy returns proxy of an app routed by server names
+func routedProxy(app, sni string, sniDefault bool) *proxy {
+	p := newRoutedProxy(app, "127.0.0.1:443")
+	p.options = options{sni: sni, sniDefault: sniDefault}
+
+	return p
+}
+
+func TestRouterRebuildKeepsRoutes(t *testing.T) {
+	r := &router{listen: "127.0.0.1:443", proxies: map[string]*proxy{}, names: map[string]*proxy{}}
+
+	zzz := routedProxy("zzz", "a.example.com", true)
+	r.set(zzz)
+
+	if conflicts := r.rebuild(); len(conflicts) != 0 {
+		t.Fatalf("expected no conflicts, got %v", conflicts)
+	}
+
+	aaa := routedProxy("aaa", "a.example.com, b.example.com", true)
+	r.set(aaa)
+
+	expected := []Conflict{
+		{Listen: r.listen, ServerName: "a.example.com", App: "aaa", Owner: "zzz"},
+		{Listen: r.listen, ServerName: "*", App: "aaa", Owner: "zzz"},
+	}
+
+	if conflicts := r.rebuild(); !reflect.DeepEqual(conflicts, expected) {
+		t.Errorf("expected conflicts %v, got %v", expected, conflicts)
+	}
+
+	routes := map[string]*proxy{
+		"a.example.com": zzz,
+		"b.example.com": aaa,
+		"c.example.com": zzz,
+	}
+
+	for name, p := range routes {
+		if routed := r.lookup(name); routed != p {
+			t.Errorf("lookup of %q: expected %s, got %s", name, appOf(p), appOf(routed))
+		}
+	}
+
+	r.set(routedProxy("zzz", "c.example.com", false))
+
+	if conflicts := r.rebuild(); len(conflicts) != 0 {
+		t.Errorf("expected no conflicts after claims are dropped, got %v", conflicts)
+	}
+
+	for _, name := range []string{"a.example.com", "d.example.com"} {
+		if routed := r.lookup(name); routed != aaa {
+			t.Errorf("lookup of %q: expected aaa after claims are dropped, got %s", name, appOf(routed))
+		}
+	}
+}
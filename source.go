@@ -0,0 +1,298 @@
+package zoidbergtcp
+
+import (
+	"log"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/bobrik/zoidberg/application"
+	"github.com/bobrik/zoidberg/balancer"
+	"github.com/bobrik/zoidberg/state"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultSource is the name of the source that
+// state updated with UpdateState comes from
+const defaultSource = "default"
+
+var sourceApps = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "zoidberg_proxy_source_apps",
+		Help: "number of apps in the effective state that come from each zoidberg source",
+	},
+	[]string{"source"},
+)
+
+func init() {
+	prometheus.MustRegister(sourceApps)
+}
+
+// Source is the last state pushed by a zoidberg instance with its name
+type Source struct {
+	Name    string         `json:"name"`
+	State   balancer.State `json:"state"`
+	Updated time.Time      `json:"updated"`
+}
+
+// SourceInfo describes a zoidberg source, apps are the ones it pushed,
+// expiration is only set when sources expire after inactivity
+type SourceInfo struct {
+	Name     string      `json:"name"`
+	Priority int         `json:"priority"`
+	Updated  time.Time   `json:"updated"`
+	Expires  *time.Time  `json:"expires,omitempty"`
+	Apps     []string    `json:"apps"`
+	Rejected []Rejection `json:"rejected"`
+}
+
+// SourceConflict describes an app pushed by a source that differs
+// from the definition of the same app from a source with higher priority
+type SourceConflict struct {
+	App    string `json:"app"`
+	Source string `json:"source"`
+	Owner  string `json:"owner"`
+}
+
+// merged is the effective state combined from all sources
+// along with the sources that apps come from
+type merged struct {
+	state     balancer.State
+	owners    map[string]string
+	conflicts []SourceConflict
+}
+
+// UpdateSource replaces the state pushed by a zoidberg source
+// and applies the effective state combined from all sources,
+// only apps of the source are reported as rejected
+func (m *Manager) UpdateSource(name string, s balancer.State) UpdateSummary {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.shutdown {
+		log.Printf("ignoring state update from %s during shutdown", name)
+		return UpdateSummary{}
+	}
+
+	source := Source{Name: name, State: s, Updated: time.Now()}
+
+	m.sources[name] = source
+	m.scheduleExpiry(source)
+
+	summary := m.apply(m.merge())
+	summary.Rejected = rejectionsOf(summary.Rejected, name)
+
+	return summary
+}
+
+// UpdateState replaces the state of the default source
+// and applies the effective state combined from all sources
+func (m *Manager) UpdateState(s balancer.State) UpdateSummary {
+	return m.UpdateSource(defaultSource, s)
+}
+
+// rejectionsOf returns rejections of apps that come from a source
+func rejectionsOf(rejected []Rejection, source string) []Rejection {
+	filtered := []Rejection{}
+	for _, rejection := range rejected {
+		if rejection.Source == source {
+			filtered = append(filtered, rejection)
+		}
+	}
+
+	return filtered
+}
+
+// Sources describes zoidberg sources in order of their priority
+func (m *Manager) Sources() []SourceInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	infos := []SourceInfo{}
+	for i, name := range m.sourceOrder() {
+		source := m.sources[name]
+
+		info := SourceInfo{
+			Name:     name,
+			Priority: i,
+			Updated:  source.Updated,
+			Apps:     make([]string, 0, len(source.State.Apps)),
+			Rejected: rejectionsOf(m.rejected, name),
+		}
+
+		if m.config.SourceTimeout > 0 {
+			expires := source.Updated.Add(m.config.SourceTimeout)
+			info.Expires = &expires
+		}
+
+		for app := range source.State.Apps {
+			info.Apps = append(info.Apps, app)
+		}
+
+		sort.Strings(info.Apps)
+
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
+// scheduleExpiry removes source once it has not pushed
+// its state for longer than the configured timeout
+func (m *Manager) scheduleExpiry(source Source) {
+	if m.config.SourceTimeout == 0 {
+		return
+	}
+
+	if timer, ok := m.expiry[source.Name]; ok {
+		timer.Stop()
+	}
+
+	delay := time.Until(source.Updated.Add(m.config.SourceTimeout))
+
+	m.expiry[source.Name] = time.AfterFunc(delay, func() {
+		m.expireSource(source)
+	})
+}
+
+// expireSource removes source unless it pushed a newer state already
+// and applies the effective state combined from the remaining sources
+func (m *Manager) expireSource(source Source) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	current, ok := m.sources[source.Name]
+	if !ok || !current.Updated.Equal(source.Updated) || m.shutdown {
+		return
+	}
+
+	log.Printf("source %s has not pushed state since %s, removing its apps", source.Name, source.Updated.Format(time.RFC3339))
+
+	delete(m.sources, source.Name)
+	delete(m.expiry, source.Name)
+
+	m.apply(m.merge())
+}
+
+// sourceOrder returns names of sources in order of their priority:
+// sources from the configured priority list go first, others
+// follow in order of their names
+func (m *Manager) sourceOrder() []string {
+	rank := map[string]int{}
+	for i, name := range m.config.SourcePriority {
+		if _, ok := rank[name]; !ok {
+			rank[name] = i
+		}
+	}
+
+	names := make([]string, 0, len(m.sources))
+	for name := range m.sources {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		ri, iRanked := rank[names[i]]
+		rj, jRanked := rank[names[j]]
+
+		if iRanked != jRanked {
+			return iRanked
+		}
+
+		if iRanked && ri != rj {
+			return ri < rj
+		}
+
+		return names[i] < names[j]
+	})
+
+	return names
+}
+
+// merge combines apps of all sources into the effective state, sources
+// are considered in order of their priority and the first one pushing
+// an app owns it, differing definitions from other sources are conflicts
+func (m *Manager) merge() merged {
+	result := merged{
+		state: balancer.State{
+			Apps:  application.Apps{},
+			State: state.State{Versions: map[string]state.Versions{}},
+		},
+		owners:    map[string]string{},
+		conflicts: []SourceConflict{},
+	}
+
+	sourceApps.Reset()
+
+	for _, name := range m.sourceOrder() {
+		source := m.sources[name]
+		owned := 0
+
+		for app, definition := range source.State.Apps {
+			if owner, ok := result.owners[app]; ok {
+				if !reflect.DeepEqual(result.state.Apps[app], definition) {
+					result.conflicts = append(result.conflicts, SourceConflict{App: app, Source: name, Owner: owner})
+				}
+
+				continue
+			}
+
+			result.owners[app] = name
+			result.state.Apps[app] = definition
+
+			if versions, ok := source.State.State.Versions[app]; ok {
+				result.state.State.Versions[app] = versions
+			}
+
+			owned++
+		}
+
+		sourceApps.With(prometheus.Labels{"source": name}).Set(float64(owned))
+	}
+
+	sort.Slice(result.conflicts, func(i, j int) bool {
+		if result.conflicts[i].App != result.conflicts[j].App {
+			return result.conflicts[i].App < result.conflicts[j].App
+		}
+
+		return result.conflicts[i].Source < result.conflicts[j].Source
+	})
+
+	for _, conflict := range result.conflicts {
+		log.Printf("source %s pushes app %s that differs from the one of source %s", conflict.Source, conflict.App, conflict.Owner)
+	}
+
+	return result
+}
+
+// Snapshot returns the effective state along with states of all sources
+// to be passed to a child process on upgrade
+func (m *Manager) Snapshot() Snapshot {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	snapshot := Snapshot{State: m.state, Sources: []Source{}}
+	for _, name := range m.sourceOrder() {
+		snapshot.Sources = append(snapshot.Sources, m.sources[name])
+	}
+
+	return snapshot
+}
+
+// Restore applies a snapshot received from the parent process, sources
+// keep their update times, so they expire as if there was no upgrade,
+// the effective state is applied as is if the parent did not pass sources
+func (m *Manager) Restore(snapshot Snapshot) UpdateSummary {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(snapshot.Sources) == 0 {
+		return m.apply(merged{state: snapshot.State, owners: map[string]string{}, conflicts: []SourceConflict{}})
+	}
+
+	for _, source := range snapshot.Sources {
+		m.sources[source.Name] = source
+		m.scheduleExpiry(source)
+	}
+
+	return m.apply(m.merge())
+}
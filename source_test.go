@@ -0,0 +1,149 @@
+package zoidbergtcp
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/bobrik/zoidberg/application"
+	"github.com/bobrik/zoidberg/balancer"
+	"github.com/bobrik/zoidberg/state"
+)
+
+// sourceState returns state with apps listening on the given addresses,
+// every app has a single version of the given weight
+func sourceState(listens map[string]string, weight int) balancer.State {
+	s := balancer.State{
+		Apps:  application.Apps{},
+		State: state.State{Versions: map[string]state.Versions{}},
+	}
+
+	for name, listen := range listens {
+		s.Apps[name] = application.App{Name: name, Meta: map[string]string{"listen": listen}}
+		s.State.Versions[name] = state.Versions{"v1": state.Version{Weight: weight}}
+	}
+
+	return s
+}
+
+func TestMerge(t *testing.T) {
+	cases := []struct {
+		name      string
+		priority  []string
+		sources   map[string]balancer.State
+		owners    map[string]string
+		weights   map[string]int
+		conflicts []SourceConflict
+	}{
+		{
+			name: "disjoint apps",
+			sources: map[string]balancer.State{
+				"z1": sourceState(map[string]string{"a": "127.0.0.1:10001"}, 1),
+				"z2": sourceState(map[string]string{"b": "127.0.0.1:10002"}, 2),
+			},
+			owners:    map[string]string{"a": "z1", "b": "z2"},
+			weights:   map[string]int{"a": 1, "b": 2},
+			conflicts: []SourceConflict{},
+		},
+		{
+			name: "same definitions",
+			sources: map[string]balancer.State{
+				"z1": sourceState(map[string]string{"a": "127.0.0.1:10001"}, 1),
+				"z2": sourceState(map[string]string{"a": "127.0.0.1:10001"}, 2),
+			},
+			owners:    map[string]string{"a": "z1"},
+			weights:   map[string]int{"a": 1},
+			conflicts: []SourceConflict{},
+		},
+		{
+			name: "different definitions in order of names",
+			sources: map[string]balancer.State{
+				"z2": sourceState(map[string]string{"a": "127.0.0.1:10002"}, 2),
+				"z1": sourceState(map[string]string{"a": "127.0.0.1:10001"}, 1),
+			},
+			owners:    map[string]string{"a": "z1"},
+			weights:   map[string]int{"a": 1},
+			conflicts: []SourceConflict{{App: "a", Source: "z2", Owner: "z1"}},
+		},
+		{
+			name:     "different definitions in order of priority",
+			priority: []string{"z3", "z2", "z3"},
+			sources: map[string]balancer.State{
+				"z1": sourceState(map[string]string{"a": "127.0.0.1:10001"}, 1),
+				"z2": sourceState(map[string]string{"a": "127.0.0.1:10002", "b": "127.0.0.1:10004"}, 2),
+				"z3": sourceState(map[string]string{"a": "127.0.0.1:10003"}, 3),
+			},
+			owners:  map[string]string{"a": "z3", "b": "z2"},
+			weights: map[string]int{"a": 3, "b": 2},
+			conflicts: []SourceConflict{
+				{App: "a", Source: "z1", Owner: "z3"},
+				{App: "a", Source: "z2", Owner: "z3"},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := NewManager(Config{SourcePriority: c.priority})
+
+			for name, s := range c.sources {
+				m.sources[name] = Source{Name: name, State: s}
+			}
+
+			result := m.merge()
+
+			if !reflect.DeepEqual(result.owners, c.owners) {
+				t.Errorf("expected owners %v, got %v", c.owners, result.owners)
+			}
+
+			for app, weight := range c.weights {
+				if w := result.state.State.Versions[app]["v1"].Weight; w != weight {
+					t.Errorf("expected app %s to have weight %d of its owner, got %d", app, weight, w)
+				}
+
+				if owner := c.sources[c.owners[app]].Apps[app]; !reflect.DeepEqual(result.state.Apps[app], owner) {
+					t.Errorf("expected app %s to have definition of its owner, got %v", app, result.state.Apps[app])
+				}
+			}
+
+			if len(result.state.Apps) != len(c.owners) {
+				t.Errorf("expected %d apps, got %d", len(c.owners), len(result.state.Apps))
+			}
+
+			if !reflect.DeepEqual(result.conflicts, c.conflicts) {
+				t.Errorf("expected conflicts %v, got %v", c.conflicts, result.conflicts)
+			}
+		})
+	}
+}
+
+func TestSourceOrder(t *testing.T) {
+	m := NewManager(Config{SourcePriority: []string{"c", "missing", "a", "c"}})
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		m.sources[name] = Source{Name: name}
+	}
+
+	expected := []string{"c", "a", "b", "d"}
+	if order := m.sourceOrder(); !reflect.DeepEqual(order, expected) {
+		t.Errorf("expected order %v, got %v", expected, order)
+	}
+}
+
+func TestUpdateSourceRejections(t *testing.T) {
+	m := NewManager(Config{})
+
+	invalid := balancer.State{Apps: application.Apps{"a": {Name: "a"}}}
+
+	if rejected := m.UpdateSource("z2", invalid).Rejected; len(rejected) != 1 || rejected[0].Source != "z2" {
+		t.Errorf("expected rejection of app from z2, got %v", rejected)
+	}
+
+	if rejected := m.UpdateSource("z1", balancer.State{}).Rejected; len(rejected) != 0 {
+		t.Errorf("expected no rejections for z1, got %v", rejected)
+	}
+
+	sources := m.Sources()
+	if len(sources) != 2 || len(sources[0].Rejected) != 0 || len(sources[1].Rejected) != 1 {
+		t.Errorf("expected rejection to be listed for z2 only, got %v", sources)
+	}
+}
@@ -0,0 +1,162 @@
+package zoidbergtcp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// closeFinished means that both sides closed the connection
+	closeFinished = "finished"
+
+	// closeIdleTimeout means that no data was sent in either direction
+	// for longer than idle timeout
+	closeIdleTimeout = "idle_timeout"
+
+	// closeHalfClosedTimeout means that one side closed the connection
+	// and the other one did not follow within half-closed timeout
+	closeHalfClosedTimeout = "half_closed_timeout"
+
+	// closeMaxLifetime means that the connection lived for too long
+	closeMaxLifetime = "max_lifetime"
+)
+
+var connectionsClosed = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "zoidberg_proxy_connections_closed",
+		Help: "number of proxied connections closed by reason",
+	},
+	[]string{"app", "reason"},
+)
+
+func init() {
+	prometheus.MustRegister(connectionsClosed)
+}
+
+// timeoutOptions holds limits of proxied connections, zero disables a limit
+type timeoutOptions struct {
+	idle        time.Duration
+	halfClosed  time.Duration
+	maxLifetime time.Duration
+}
+
+// activity tracks the time of the last data transfer of a connection
+type activity struct {
+	last int64
+}
+
+// newActivity creates activity that was last seen now
+func newActivity() *activity {
+	return &activity{last: time.Now().UnixNano()}
+}
+
+// touchAt records a data transfer at the given time
+func (a *activity) touchAt(t time.Time) {
+	atomic.StoreInt64(&a.last, t.UnixNano())
+}
+
+// since returns time passed since the last data transfer
+func (a *activity) since() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&a.last))
+}
+
+// connectionWatcher enforces timeouts of a proxied connection
+type connectionWatcher struct {
+	options    timeoutOptions
+	activity   *activity
+	idle       *time.Timer
+	halfClosed <-chan time.Time
+	lifetime   <-chan time.Time
+}
+
+// watch waits for both directions of a connection to finish, calling
+// flush every accounting interval and abort when any of the limits
+// is exceeded, it returns close reason
+func (o timeoutOptions) watch(done <-chan struct{}, a *activity, flush func(), abort func()) string {
+	w := connectionWatcher{options: o, activity: a}
+
+	accounting := time.NewTicker(accountingInterval)
+	defer accounting.Stop()
+
+	if o.idle > 0 {
+		w.idle = time.NewTimer(o.idle)
+		defer w.idle.Stop()
+	}
+
+	if o.maxLifetime > 0 {
+		lifetime := time.NewTimer(o.maxLifetime)
+		defer lifetime.Stop()
+		w.lifetime = lifetime.C
+	}
+
+	reason := closeFinished
+
+	for finished := 0; finished < 2; {
+		exceeded := ""
+
+		select {
+		case <-done:
+			finished++
+			w.startHalfClosed()
+		case <-w.idleC():
+			exceeded = w.checkIdle()
+		case <-w.halfClosed:
+			exceeded = closeHalfClosedTimeout
+		case <-w.lifetime:
+			exceeded = closeMaxLifetime
+		case <-accounting.C:
+			flush()
+		}
+
+		if exceeded != "" && reason == closeFinished {
+			reason = exceeded
+			w.stop()
+			abort()
+		}
+	}
+
+	return reason
+}
+
+// idleC returns channel of the idle timer, nil when it's disabled
+func (w *connectionWatcher) idleC() <-chan time.Time {
+	if w.idle == nil {
+		return nil
+	}
+
+	return w.idle.C
+}
+
+// checkIdle returns idle timeout reason if there was no activity
+// for idle timeout, otherwise it rearms idle timer
+func (w *connectionWatcher) checkIdle() string {
+	since := w.activity.since()
+	if since >= w.options.idle {
+		return closeIdleTimeout
+	}
+
+	w.idle.Reset(w.options.idle - since)
+
+	return ""
+}
+
+// startHalfClosed starts half-closed timer when one side is finished
+func (w *connectionWatcher) startHalfClosed() {
+	if w.options.halfClosed > 0 && w.halfClosed == nil {
+		w.halfClosed = time.After(w.options.halfClosed)
+	}
+}
+
+// stop disables all timers after connection is aborted
+func (w *connectionWatcher) stop() {
+	if w.idle != nil {
+		w.idle.Stop()
+		w.idle = nil
+	}
+
+	w.options = timeoutOptions{}
+	w.halfClosed = nil
+	w.lifetime = nil
+}
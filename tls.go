@@ -0,0 +1,529 @@
+package zoidbergtcp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// defaultTLSHandshakeTimeout is the default time for clients
+	// to complete TLS handshake
+	defaultTLSHandshakeTimeout = 10 * time.Second
+
+	// defaultTLSMinVersion is the default minimum TLS version
+	// accepted from clients
+	defaultTLSMinVersion = "1.2"
+
+	// certificateCheckInterval defines how often certificate files
+	// are checked for changes
+	certificateCheckInterval = 5 * time.Second
+)
+
+var (
+	tlsHandshakeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "zoidberg_proxy_tls_handshake_duration_seconds",
+			Help: "duration of successful TLS handshakes with clients",
+		},
+		[]string{"app"},
+	)
+
+	tlsHandshakeErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "zoidberg_proxy_tls_handshake_errors",
+			Help: "number of failed TLS handshakes with clients by reason",
+		},
+		[]string{"app", "reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(tlsHandshakeDuration)
+	prometheus.MustRegister(tlsHandshakeErrors)
+}
+
+// errClientNotAllowed is returned when identity of a verified
+// client certificate is not in the list of allowed ones
+var errClientNotAllowed = errors.New("client certificate identity is not allowed")
+
+// errClientCertificateMissing is returned when a client
+// does not present a certificate while it is required
+var errClientCertificateMissing = errors.New("client certificate is required")
+
+// tlsVersions maps version names to TLS versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsVersionNames returns names of supported TLS versions
+func tlsVersionNames() []string {
+	names := make([]string, 0, len(tlsVersions))
+	for name := range tlsVersions {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// parseCipherSuites parses comma separated list of cipher suite names
+func parseCipherSuites(names string) ([]uint16, error) {
+	if names == "" {
+		return nil, nil
+	}
+
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := []uint16{}
+
+	for _, name := range strings.Split(names, ",") {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite: %q", name)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// tlsOptions holds settings of TLS termination,
+// relative paths of certificates are resolved against dir
+type tlsOptions struct {
+	enabled          bool
+	dir              string
+	cert             string
+	key              string
+	minVersion       string
+	ciphers          string
+	handshakeTimeout time.Duration
+	clientCA         string
+	clientAllow      string
+}
+
+// path returns the path of a certificate file
+func (o tlsOptions) path(file string) string {
+	if filepath.IsAbs(file) {
+		return file
+	}
+
+	return filepath.Join(o.dir, file)
+}
+
+// newServerTLSConfig creates TLS config for terminating client
+// connections, certificate is reloaded when its files change
+func newServerTLSConfig(app string, o tlsOptions) (*tls.Config, error) {
+	ciphers, err := parseCipherSuites(o.ciphers)
+	if err != nil {
+		return nil, err
+	}
+
+	loader, err := newCertificateLoader(app, o.path(o.cert), o.path(o.key))
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return loader.current(), nil
+		},
+		MinVersion:   tlsVersions[o.minVersion],
+		CipherSuites: ciphers,
+	}
+
+	if o.clientCA == "" {
+		return config, nil
+	}
+
+	// certificates are verified if given, missing ones are rejected
+	// by verifyClient to tell them apart from untrusted ones
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if config.ClientCAs, err = loadCertPool(o.path(o.clientCA)); err != nil {
+		return nil, err
+	}
+
+	allowed := []string{}
+	if o.clientAllow != "" {
+		allowed = strings.Split(o.clientAllow, ",")
+	}
+
+	config.VerifyConnection = verifyClient(allowed)
+
+	return config, nil
+}
+
+// verifyClient returns connection verifier that requires a client
+// certificate and, if the list of allowed identities is not empty,
+// only allows certificates with subject common name or any
+// of alternative names matching one of the allowed identities
+func verifyClient(allowed []string) func(tls.ConnectionState) error {
+	set := map[string]bool{}
+	for _, identity := range allowed {
+		set[strings.TrimSpace(identity)] = true
+	}
+
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errClientCertificateMissing
+		}
+
+		if len(set) == 0 {
+			return nil
+		}
+
+		certificate := state.PeerCertificates[0]
+
+		for _, identity := range certificateIdentities(certificate) {
+			if set[identity] {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("%w: %q", errClientNotAllowed, certificateIdentity(certificate))
+	}
+}
+
+// certificateIdentities returns subject common name
+// and all alternative names of a certificate
+func certificateIdentities(certificate *x509.Certificate) []string {
+	identities := []string{}
+	if certificate.Subject.CommonName != "" {
+		identities = append(identities, certificate.Subject.CommonName)
+	}
+
+	identities = append(identities, certificate.DNSNames...)
+	identities = append(identities, certificate.EmailAddresses...)
+
+	for _, uri := range certificate.URIs {
+		identities = append(identities, uri.String())
+	}
+
+	for _, ip := range certificate.IPAddresses {
+		identities = append(identities, ip.String())
+	}
+
+	return identities
+}
+
+// certificateIdentity returns the most specific identity of a certificate
+// for logging, it is subject common name or the first alternative name
+func certificateIdentity(certificate *x509.Certificate) string {
+	identities := certificateIdentities(certificate)
+	if len(identities) == 0 {
+		return certificate.Subject.String()
+	}
+
+	return identities[0]
+}
+
+// loadCertPool loads certificate pool from a PEM bundle
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+
+	return pool, nil
+}
+
+// upstreamTLSOptions holds settings of TLS connections to upstreams,
+// relative paths of certificates are resolved against dir
+type upstreamTLSOptions struct {
+	enabled    bool
+	dir        string
+	ca         string
+	serverName string
+	cert       string
+	key        string
+}
+
+// path returns the path of a certificate file
+func (o upstreamTLSOptions) path(file string) string {
+	return tlsOptions{dir: o.dir}.path(file)
+}
+
+// newUpstreamTLSConfig creates TLS config for connecting to upstreams,
+// system roots are used when CA bundle is not set and client
+// certificate is only presented when it's configured
+func newUpstreamTLSConfig(app string, o upstreamTLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         o.serverName,
+		ClientSessionCache: tls.NewLRUClientSessionCache(0),
+	}
+
+	if o.ca != "" {
+		var err error
+		if config.RootCAs, err = loadCertPool(o.path(o.ca)); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.cert != "" {
+		loader, err := newCertificateLoader(app, o.path(o.cert), o.path(o.key))
+		if err != nil {
+			return nil, err
+		}
+
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return loader.current(), nil
+		}
+	}
+
+	return config, nil
+}
+
+// certificateLoader loads certificate from files and reloads it
+// when modification time of any of the files changes
+type certificateLoader struct {
+	mutex       sync.Mutex
+	app         string
+	cert        string
+	key         string
+	certificate *tls.Certificate
+	modified    time.Time
+	checked     time.Time
+}
+
+// newCertificateLoader creates certificate loader
+// and loads certificate for the first time
+func newCertificateLoader(app, cert, key string) (*certificateLoader, error) {
+	l := &certificateLoader{
+		mutex: sync.Mutex{},
+		app:   app,
+		cert:  cert,
+		key:   key,
+	}
+
+	certificate, modified, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+
+	l.certificate = certificate
+	l.modified = modified
+	l.checked = time.Now()
+
+	return l, nil
+}
+
+// current returns the current certificate, reloading it if needed
+func (l *certificateLoader) current() *tls.Certificate {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if time.Since(l.checked) >= certificateCheckInterval {
+		l.checked = time.Now()
+
+		if modified, err := l.lastModified(); err != nil {
+			l.log(fmt.Sprintf("error checking certificate: %s", err))
+		} else if modified != l.modified {
+			l.reload()
+		}
+	}
+
+	return l.certificate
+}
+
+// reload loads certificate keeping the old one on errors,
+// it must be called with mutex held
+func (l *certificateLoader) reload() {
+	certificate, modified, err := l.read()
+	if err != nil {
+		l.log(fmt.Sprintf("error reloading certificate: %s", err))
+		return
+	}
+
+	l.certificate = certificate
+	l.modified = modified
+
+	l.log(fmt.Sprintf("reloaded certificate from %s", l.cert))
+}
+
+// read reads certificate and key from files
+func (l *certificateLoader) read() (*tls.Certificate, time.Time, error) {
+	modified, err := l.lastModified()
+	if err != nil {
+		return nil, modified, err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(l.cert, l.key)
+	if err != nil {
+		return nil, modified, err
+	}
+
+	return &certificate, modified, nil
+}
+
+// lastModified returns the latest modification time of certificate files
+func (l *certificateLoader) lastModified() (time.Time, error) {
+	latest := time.Time{}
+
+	for _, file := range []string{l.cert, l.key} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+func (l *certificateLoader) log(msg string) {
+	log.Printf("tls[app=%s]: %s", l.app, msg)
+}
+
+// handshake performs TLS handshake with a client within timeout
+func (p *proxy) handshake(conn net.Conn, config *tls.Config, timeout time.Duration) (*tls.Conn, error) {
+	started := time.Now()
+
+	server := tls.Server(conn, config)
+
+	err := server.SetDeadline(started.Add(timeout))
+	if err == nil {
+		err = server.Handshake()
+	}
+
+	if err == nil {
+		err = server.SetDeadline(time.Time{})
+	}
+
+	if err != nil {
+		tlsHandshakeErrors.With(prometheus.Labels{"app": p.app, "reason": handshakeErrorReason(err)}).Inc()
+		return nil, err
+	}
+
+	tlsHandshakeDuration.With(p.labels).Observe(time.Since(started).Seconds())
+
+	return server, nil
+}
+
+// handshakeErrorReasons maps handshake errors to short reasons for metrics,
+// the first matching reason is used, errors are matched by their types
+// where crypto/tls has them and by their messages otherwise
+var handshakeErrorReasons = []struct {
+	reason  string
+	matches func(err error) bool
+}{
+	{"timeout", isTimeout},
+	{"eof", func(err error) bool { return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) }},
+	{"not_tls", func(err error) bool { return errors.As(err, &tls.RecordHeaderError{}) }},
+	{"client_not_allowed", func(err error) bool { return errors.Is(err, errClientNotAllowed) }},
+	{"client_certificate_missing", func(err error) bool { return errors.Is(err, errClientCertificateMissing) }},
+	{"client_certificate_untrusted", isUntrustedCertificate},
+	{"reset", func(err error) bool { return errors.Is(err, syscall.ECONNRESET) }},
+	{"protocol_version", messageContains("protocol version", "unsupported versions")},
+	{"cipher_suite", messageContains("cipher suite")},
+	{"certificate", messageContains("certificate")},
+}
+
+// handshakeErrorReason returns short reason of a handshake error for metrics
+func handshakeErrorReason(err error) string {
+	for _, r := range handshakeErrorReasons {
+		if r.matches(err) {
+			return r.reason
+		}
+	}
+
+	return "other"
+}
+
+// isTimeout returns whether an error is a network timeout
+func isTimeout(err error) bool {
+	var e net.Error
+	return errors.As(err, &e) && e.Timeout()
+}
+
+// isUntrustedCertificate returns whether an error
+// is a failed verification of a certificate chain
+func isUntrustedCertificate(err error) bool {
+	var verification *tls.CertificateVerificationError
+	var authority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+
+	return errors.As(err, &verification) || errors.As(err, &authority) || errors.As(err, &invalid)
+}
+
+// messageContains returns a matcher of errors with messages
+// containing any of the given parts
+func messageContains(parts ...string) func(err error) bool {
+	return func(err error) bool {
+		for _, part := range parts {
+			if strings.Contains(err.Error(), part) {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// upstreamHandshake performs TLS handshake with an upstream before deadline,
+// upstream host is verified if server name is not set explicitly
+func upstreamHandshake(conn net.Conn, upstream Upstream, config *tls.Config, deadline time.Time) (*tls.Conn, error) {
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = upstream.Host()
+	}
+
+	client := tls.Client(conn, config)
+
+	err := client.SetDeadline(deadline)
+	if err == nil {
+		err = client.Handshake()
+	}
+
+	if err == nil {
+		err = client.SetDeadline(time.Time{})
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// handshakeDeadline returns deadline of TLS handshake with an upstream,
+// it is limited by both timeout and deadline of the dialer
+func handshakeDeadline(dialer net.Dialer) time.Time {
+	deadline := dialer.Deadline
+	if dialer.Timeout > 0 {
+		timeout := time.Now().Add(dialer.Timeout)
+		if deadline.IsZero() || timeout.Before(deadline) {
+			deadline = timeout
+		}
+	}
+
+	return deadline
+}
@@ -0,0 +1,99 @@
+package zoidbergtcp
+
+import (
+	"net"
+	"sort"
+)
+
+// ProxyInfo describes a running proxy of an app
+type ProxyInfo struct {
+	App         string         `json:"app"`
+	Listen      string         `json:"listen"`
+	Listeners   []string       `json:"listeners"`
+	Shared      bool           `json:"shared"`
+	Draining    bool           `json:"draining"`
+	Balance     string         `json:"balance"`
+	Connections int            `json:"connections"`
+	Upstreams   []UpstreamInfo `json:"upstreams"`
+}
+
+// UpstreamInfo describes an upstream of a proxy, upstreams without
+// health checks are always healthy
+type UpstreamInfo struct {
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	Weight      int    `json:"weight"`
+	Healthy     bool   `json:"healthy"`
+	Ejected     bool   `json:"ejected"`
+	Override    string `json:"override,omitempty"`
+	Connections int    `json:"connections"`
+}
+
+// Proxies returns descriptions of active and draining proxies
+func (m *Manager) Proxies() []ProxyInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	proxies := []ProxyInfo{}
+
+	for _, proxy := range m.proxies {
+		proxies = append(proxies, proxy.info(proxy.listeners))
+	}
+
+	for _, router := range m.routers {
+		for _, proxy := range router.all() {
+			info := proxy.info(router.listeners)
+			info.Shared = true
+			proxies = append(proxies, info)
+		}
+	}
+
+	for proxy := range m.draining {
+		info := proxy.info(nil)
+		info.Draining = true
+		proxies = append(proxies, info)
+	}
+
+	sort.Slice(proxies, func(i, j int) bool {
+		if proxies[i].Listen != proxies[j].Listen {
+			return proxies[i].Listen < proxies[j].Listen
+		}
+
+		return proxies[i].App < proxies[j].App
+	})
+
+	return proxies
+}
+
+// info describes the proxy with the given listeners
+func (p *proxy) info(listeners []net.Listener) ProxyInfo {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	info := ProxyInfo{
+		App:         p.app,
+		Listen:      p.listen,
+		Listeners:   make([]string, 0, len(listeners)),
+		Balance:     p.options.balance,
+		Connections: len(p.conns),
+		Upstreams:   make([]UpstreamInfo, 0, len(p.upstreams)),
+	}
+
+	for _, listener := range listeners {
+		info.Listeners = append(info.Listeners, listener.Addr().String())
+	}
+
+	for _, upstream := range p.upstreams {
+		info.Upstreams = append(info.Upstreams, UpstreamInfo{
+			Host:        upstream.host,
+			Port:        upstream.port,
+			Weight:      upstream.weight,
+			Healthy:     p.health == nil || p.health.healthy(upstream),
+			Ejected:     p.outliers != nil && p.outliers.ejected(upstream),
+			Override:    p.overrides.mode(upstream),
+			Connections: p.active[upstream.Addr()],
+		})
+	}
+
+	return info
+}
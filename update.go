@@ -0,0 +1,189 @@
+package zoidbergtcp
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/bobrik/zoidberg/application"
+	"github.com/bobrik/zoidberg/balancer"
+)
+
+// Rejection describes an app of a state update that was not applied
+type Rejection struct {
+	App    string `json:"app"`
+	Source string `json:"source,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// UpdateSummary describes changes applied by a state update, apps
+// are listed by names, rejected apps keep their previous definitions
+type UpdateSummary struct {
+	Added           []string         `json:"added"`
+	Updated         []string         `json:"updated"`
+	Removed         []string         `json:"removed"`
+	Rejected        []Rejection      `json:"rejected"`
+	Conflicts       []Conflict       `json:"conflicts"`
+	SourceConflicts []SourceConflict `json:"source_conflicts"`
+}
+
+// acceptApps returns apps that pass validation along with rejections of
+// the rest, rejected apps are replaced with their last accepted versions,
+// owners map apps to the sources they come from
+func (m *Manager) acceptApps(apps application.Apps, owners map[string]string) (application.Apps, []Rejection) {
+	accepted := application.Apps{}
+	rejected := []Rejection{}
+
+	for name, app := range apps {
+		if err := validateApp(name, app, m.config); err != nil {
+			rejected = append(rejected, Rejection{App: name, Source: owners[name], Reason: err.Error()})
+
+			if previous, ok := m.state.Apps[name]; ok {
+				accepted[name] = previous
+			}
+
+			continue
+		}
+
+		accepted[name] = app
+	}
+
+	sortRejections(rejected)
+
+	for _, rejection := range rejected {
+		m.logRejection(rejection)
+	}
+
+	return accepted, rejected
+}
+
+// sortRejections sorts rejections by names of apps
+func sortRejections(rejected []Rejection) {
+	sort.Slice(rejected, func(i, j int) bool {
+		return rejected[i].App < rejected[j].App
+	})
+}
+
+// logRejection logs rejected app, mentioning if its previous version is kept
+func (m *Manager) logRejection(rejection Rejection) {
+	if _, ok := m.state.Apps[rejection.App]; ok {
+		log.Printf("rejected app %q from source %q, keeping previous version: %s", rejection.App, rejection.Source, rejection.Reason)
+		return
+	}
+
+	log.Printf("rejected app %q from source %q: %s", rejection.App, rejection.Source, rejection.Reason)
+}
+
+// validateApp checks that an app can be served: it has a name,
+// a valid listen address, valid servers and valid meta
+func validateApp(name string, app application.App, config Config) error {
+	if app.Name == "" {
+		return fmt.Errorf("app name is empty")
+	}
+
+	if app.Name != name {
+		return fmt.Errorf("app name %q does not match its key", app.Name)
+	}
+
+	if err := validateAddress(app.Meta["listen"]); err != nil {
+		return fmt.Errorf("invalid listen: %s", err)
+	}
+
+	for _, server := range app.Servers {
+		if server.Host == "" {
+			return fmt.Errorf("server with port %d has no host", server.Port)
+		}
+
+		if server.Port < 1 || server.Port > 65535 {
+			return fmt.Errorf("server %s has port %d out of range", server.Host, server.Port)
+		}
+	}
+
+	if _, err := parseOptions(app.Name, app.Meta, config); err != nil {
+		return fmt.Errorf("invalid meta: %s", err)
+	}
+
+	return nil
+}
+
+// validateAddress checks that address is host:port with port in range
+func validateAddress(address string) error {
+	if address == "" {
+		return fmt.Errorf("address is not set")
+	}
+
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("port %q is out of range", port)
+	}
+
+	return nil
+}
+
+// runningApps returns names of apps that have proxies
+func (m *Manager) runningApps() map[string]bool {
+	apps := map[string]bool{}
+	for _, proxy := range m.proxies {
+		apps[proxy.app] = true
+	}
+
+	for _, router := range m.routers {
+		for _, proxy := range router.all() {
+			apps[proxy.app] = true
+		}
+	}
+
+	return apps
+}
+
+// summarize describes the difference between apps that had proxies before
+// the update and apps that have them now, apps that kept their proxies
+// are updated only if their definitions or versions changed
+func (m *Manager) summarize(before map[string]bool, previous balancer.State, rejected []Rejection) UpdateSummary {
+	after := m.runningApps()
+
+	summary := UpdateSummary{
+		Added:     []string{},
+		Updated:   []string{},
+		Removed:   []string{},
+		Rejected:  rejected,
+		Conflicts: m.conflicts,
+	}
+
+	for app := range after {
+		if !before[app] {
+			summary.Added = append(summary.Added, app)
+		} else if m.changed(app, previous) {
+			summary.Updated = append(summary.Updated, app)
+		}
+	}
+
+	for app := range before {
+		if !after[app] {
+			summary.Removed = append(summary.Removed, app)
+		}
+	}
+
+	sort.Strings(summary.Added)
+	sort.Strings(summary.Updated)
+	sort.Strings(summary.Removed)
+
+	return summary
+}
+
+// changed returns whether definition or versions of an app
+// in the current state differ from the ones in previous state
+func (m *Manager) changed(app string, previous balancer.State) bool {
+	if !reflect.DeepEqual(previous.Apps[app], m.state.Apps[app]) {
+		return true
+	}
+
+	return !reflect.DeepEqual(previous.State.Versions[app], m.state.State.Versions[app])
+}
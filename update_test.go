@@ -0,0 +1,81 @@
+package zoidbergtcp
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/bobrik/zoidberg/application"
+	"github.com/bobrik/zoidberg/balancer"
+)
+
+// freeAddress returns a loopback address that nothing listens on
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	address := listener.Addr().String()
+
+	if err := listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return address
+}
+
+// singleApp returns state with a single app
+func singleApp(name string, meta map[string]string) balancer.State {
+	return balancer.State{Apps: application.Apps{
+		name: {Name: name, Meta: meta, Servers: []application.Server{{Host: "127.0.0.1", Port: 1}}},
+	}}
+}
+
+func TestUpdateStateProxyFailures(t *testing.T) {
+	m := NewManager(Config{DrainTimeout: time.Second, TLSCertDir: t.TempDir()})
+
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		_ = m.Shutdown(ctx)
+	}()
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		_ = taken.Close()
+	}()
+
+	summary := m.UpdateState(singleApp("a", map[string]string{"listen": taken.Addr().String()}))
+	if len(summary.Added) != 0 || len(summary.Rejected) != 1 || summary.Rejected[0].App != "a" {
+		t.Errorf("expected app on a taken address to be rejected, got %+v", summary)
+	}
+
+	if _, ok := m.State().Apps["a"]; ok {
+		t.Errorf("expected app on a taken address to be left out of state")
+	}
+
+	plain := singleApp("b", map[string]string{"listen": freeAddress(t)})
+
+	if summary := m.UpdateState(plain); !reflect.DeepEqual(summary.Added, []string{"b"}) || len(summary.Rejected) != 0 {
+		t.Fatalf("expected app to be added, got %+v", summary)
+	}
+
+	tls := singleApp("b", map[string]string{"listen": plain.Apps["b"].Meta["listen"], "tls": "true"})
+
+	summary = m.UpdateState(tls)
+	if len(summary.Updated) != 0 || len(summary.Rejected) != 1 || summary.Rejected[0].App != "b" {
+		t.Errorf("expected update with missing certificate to be rejected, got %+v", summary)
+	}
+
+	if app := m.State().Apps["b"]; !reflect.DeepEqual(app, plain.Apps["b"]) {
+		t.Errorf("expected previous definition to be kept, got %+v", app)
+	}
+}
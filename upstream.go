@@ -1,12 +1,39 @@
 package zoidbergtcp
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
 
 // Upstream is a single upstream server
 type Upstream struct {
-	host   string
-	port   int
-	weight int
+	host        string
+	port        int
+	weight      int
+	connections int
+}
+
+// Host returns host of an upstream
+func (u Upstream) Host() string {
+	return u.host
+}
+
+// Port returns port of an upstream
+func (u Upstream) Port() int {
+	return u.port
+}
+
+// Weight returns weight of an upstream
+func (u Upstream) Weight() int {
+	return u.weight
+}
+
+// Connections returns the number of active proxied connections
+// to an upstream at the moment when balancing decision is made
+func (u Upstream) Connections() int {
+	return u.connections
 }
 
 // Addr returns network address of an upstream
@@ -25,3 +52,25 @@ type Upstreams []Upstream
 func (u Upstreams) Len() int           { return len(u) }
 func (u Upstreams) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
 func (u Upstreams) Less(i, j int) bool { return u[i].String() < u[j].String() }
+
+// shuffle returns upstreams in random order where upstreams with higher
+// weights are proportionally more likely to come first, this is weighted
+// random sampling without replacement by Efraimidis and Spirakis
+func (u Upstreams) shuffle() Upstreams {
+	keys := make([]float64, len(u))
+	order := make([]int, len(u))
+
+	for i, upstream := range u {
+		keys[i] = -math.Log(1-rand.Float64()) / float64(upstream.weight)
+		order[i] = i
+	}
+
+	sort.Slice(order, func(i, j int) bool { return keys[order[i]] < keys[order[j]] })
+
+	shuffled := make(Upstreams, len(u))
+	for i, j := range order {
+		shuffled[i] = u[j]
+	}
+
+	return shuffled
+}